@@ -53,6 +53,16 @@ func main() {
 			json.NewEncoder(w).Encode(gw.Stats())
 			return
 		}
+		if r.URL.Path == "/stats/client" {
+			info, ok := gw.InspectClient(r.URL.Query().Get("key"))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(info)
+			return
+		}
 		gw.Handler().ServeHTTP(w, r)
 	})
 
@@ -62,6 +72,7 @@ func main() {
 	log.Println("  curl http://localhost:8080/api/hello")
 	log.Println("  curl http://localhost:8080/api/data")
 	log.Println("  curl http://localhost:8080/stats")
+	log.Println("  curl 'http://localhost:8080/stats/client?key=127.0.0.1'")
 	log.Println("\nTo test rate limiting:")
 	log.Println("  for i in {1..15}; do curl http://localhost:8080/api/hello; done")
 	
@@ -2,10 +2,14 @@ package gateway
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"sync"
 	"time"
@@ -42,6 +46,44 @@ type Route struct {
 	Backends []*Backend
 	current  int
 	mu       sync.Mutex
+
+	limit       ratelimit.Policy      // Shared by all clients of the route
+	clientLimit ratelimit.Policy      // Applied to each client of the route
+	aimd        *ratelimit.AIMDConfig // Adaptive limit shared by all clients
+	adaptive    *ratelimit.AdaptiveLimiter
+	limiter     ratelimit.RateLimiter // Every level a request on the route must pass
+	owned       []*ratelimit.Limiter  // Route limiters, stopped with the gateway
+	handler     http.Handler
+}
+
+// RouteOption configures a route added with AddRoute
+type RouteOption func(*Route)
+
+// WithRouteRateLimit limits the total rate of the route across all clients.
+// A zero RefillRate defaults to Capacity and a zero Interval to one second,
+// so Policy{Capacity: 500} means 500 requests per second.
+func WithRouteRateLimit(p ratelimit.Policy) RouteOption {
+	return func(r *Route) {
+		r.limit = p
+	}
+}
+
+// WithRouteAdaptiveRateLimit limits the total rate of the route to a rate
+// that adapts to the health of its backends: it is cut when responses fail
+// with a 5xx or slow down, and grows back as they recover. Each gateway
+// replica adapts on its own.
+func WithRouteAdaptiveRateLimit(config ratelimit.AIMDConfig) RouteOption {
+	return func(r *Route) {
+		r.aimd = &config
+	}
+}
+
+// WithRouteClientRateLimit limits each client's rate on the route, on top of
+// the gateway's per-client limit. Zero fields default as in WithRouteRateLimit.
+func WithRouteClientRateLimit(p ratelimit.Policy) RouteOption {
+	return func(r *Route) {
+		r.clientLimit = p
+	}
 }
 
 // NextBackend returns the next available backend using round-robin
@@ -63,20 +105,76 @@ func (r *Route) NextBackend() *Backend {
 
 // Gateway is the main API gateway
 type Gateway struct {
-	routes       map[string]*Route
-	limiter      *ratelimit.Limiter
-	mu           sync.RWMutex
-	healthCheck  time.Duration
-	ctx          context.Context
-	cancel       context.CancelFunc
+	routes      map[string]*Route
+	limiter     ratelimit.RateLimiter
+	levels      []ratelimit.Level  // Gateway-wide levels every request must pass
+	bandwidth   *ratelimit.Limiter // Bytes per second per client, nil when unlimited
+	clientIP    *middleware.ClientIPExtractor
+	owned       []*ratelimit.Limiter // Built by the gateway, stopped with it
+	notFound    http.Handler
+	config      Config
+	mu          sync.RWMutex
+	healthCheck time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 // Config configures the gateway
 type Config struct {
 	// RateLimit settings (requests per interval)
-	RateLimitCapacity  int64
-	RateLimitRefill    int64
-	RateLimitInterval  time.Duration
+	RateLimitCapacity int64
+	RateLimitRefill   int64
+	RateLimitInterval time.Duration
+
+	// RateLimitAlgorithm selects the per-client algorithm (defaults to token bucket)
+	RateLimitAlgorithm ratelimit.Algorithm
+
+	// RateLimitCleanupInterval is how often idle clients are removed
+	// from the built-in limiter in the background (defaults to 5 minutes)
+	RateLimitCleanupInterval time.Duration
+
+	// RateLimitMaxKeys bounds how many clients the built-in limiter tracks,
+	// evicting the least recently seen beyond it (0 means unbounded)
+	RateLimitMaxKeys int
+
+	// RateLimitStateFile, when set, is where the built-in per-client limiter
+	// checkpoints its state, and where it is restored from on startup, so
+	// clients don't get a fresh quota on every deploy
+	RateLimitStateFile string
+
+	// RateLimitCheckpointInterval is how often the state file is written
+	// (defaults to 1 minute); it is also written when the gateway stops
+	RateLimitCheckpointInterval time.Duration
+
+	// RateLimitStore keeps the gateway's rate limit state in a store shared
+	// by its replicas, so they enforce one limit between them
+	RateLimitStore ratelimit.Store
+
+	// Limiter replaces the built-in per-client limiter when set;
+	// the RateLimit* settings are ignored in that case
+	Limiter ratelimit.RateLimiter
+
+	// GlobalRateLimit limits the total rate across all clients and routes
+	// (zero Capacity means no global limit). Zero fields default as in
+	// WithRouteRateLimit.
+	GlobalRateLimit ratelimit.Policy
+
+	// ClientBandwidth limits the bytes per second each client receives in
+	// proxied response bodies, with bursts of up to one second's worth
+	// (0 means unlimited)
+	ClientBandwidth int64
+
+	// TrustedProxies are the networks of load balancers or proxies in
+	// front of the gateway. Clients are identified by the address these
+	// proxies report in Forwarded or X-Forwarded-For; without any, by the
+	// address they connect from, and forwarding headers are ignored.
+	TrustedProxies []netip.Prefix
+
+	// ClientIPv6Prefix and ClientIPv4Prefix, when set, make clients share
+	// one allowance per network of that many bits, such as a /64 for IPv6,
+	// so rotating addresses within it doesn't reset a client's limits
+	ClientIPv6Prefix int
+	ClientIPv4Prefix int
 
 	// HealthCheck interval
 	HealthCheckInterval time.Duration
@@ -102,24 +200,151 @@ func NewGateway(config Config) *Gateway {
 		config.RateLimitInterval = time.Minute
 	}
 
-	return &Gateway{
+	if config.RateLimitCleanupInterval == 0 {
+		config.RateLimitCleanupInterval = 5 * time.Minute
+	}
+
+	if config.RateLimitCheckpointInterval == 0 {
+		config.RateLimitCheckpointInterval = time.Minute
+	}
+
+	g := &Gateway{
 		routes:      make(map[string]*Route),
-		limiter:     ratelimit.NewLimiter(config.RateLimitCapacity, config.RateLimitRefill, config.RateLimitInterval),
 		healthCheck: config.HealthCheckInterval,
+		config:      config,
 		ctx:         ctx,
 		cancel:      cancel,
 	}
+
+	g.clientIP = middleware.NewClientIPExtractor(middleware.ClientIPConfig{
+		TrustedProxies: config.TrustedProxies,
+		IPv6Prefix:     config.ClientIPv6Prefix,
+		IPv4Prefix:     config.ClientIPv4Prefix,
+	})
+
+	g.limiter = config.Limiter
+	if g.limiter == nil {
+		own := g.newClientLimiter("client:", ratelimit.Policy{
+			Capacity:   config.RateLimitCapacity,
+			RefillRate: config.RateLimitRefill,
+			Interval:   config.RateLimitInterval,
+		}, g.checkpointOptions()...)
+		if config.RateLimitStateFile != "" {
+			g.restoreState(own)
+		}
+		g.owned = append(g.owned, own)
+		g.limiter = own
+	}
+	// The per-client level goes last, since a custom Limiter may not be
+	// able to refund a request that a later level rejects
+	if config.GlobalRateLimit.Capacity > 0 {
+		global := g.newSharedLimiter("global:", config.GlobalRateLimit)
+		g.owned = append(g.owned, global)
+		g.levels = append(g.levels, ratelimit.Level{
+			Name:    "global",
+			Limiter: global,
+			Key:     ratelimit.StaticKey("global"),
+		})
+	}
+	g.levels = append(g.levels, ratelimit.Level{Name: "client", Limiter: g.limiter})
+
+	if config.ClientBandwidth > 0 {
+		g.bandwidth = ratelimit.NewLimiter(
+			config.ClientBandwidth,
+			config.ClientBandwidth,
+			time.Second,
+			ratelimit.WithRefillMode(ratelimit.RefillContinuous),
+			ratelimit.WithJanitor(config.RateLimitCleanupInterval),
+			ratelimit.WithMaxKeys(config.RateLimitMaxKeys),
+		)
+		g.owned = append(g.owned, g.bandwidth)
+	}
+
+	g.notFound = g.rateLimit(ratelimit.NewComposite(g.levels...), http.HandlerFunc(http.NotFound))
+
+	return g
 }
 
-// AddRoute adds a new route to the gateway
-func (g *Gateway) AddRoute(path string, backendURLs []string) error {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+// newClientLimiter builds a per-client limiter with the gateway's settings.
+// prefix keeps its keys apart from other limiters' in a shared store.
+func (g *Gateway) newClientLimiter(prefix string, p ratelimit.Policy, extra ...ratelimit.Option) *ratelimit.Limiter {
+	opts := append(g.storeOptions(prefix),
+		ratelimit.WithAlgorithm(g.config.RateLimitAlgorithm),
+		ratelimit.WithJanitor(g.config.RateLimitCleanupInterval),
+		ratelimit.WithMaxKeys(g.config.RateLimitMaxKeys),
+	)
 
+	return ratelimit.NewLimiter(p.Capacity, p.RefillRate, p.Interval, append(opts, extra...)...)
+}
+
+// newSharedLimiter builds a limiter for a single shared key
+func (g *Gateway) newSharedLimiter(prefix string, p ratelimit.Policy) *ratelimit.Limiter {
+	p = withRouteDefaults(p)
+	opts := append(g.storeOptions(prefix),
+		ratelimit.WithAlgorithm(g.config.RateLimitAlgorithm),
+		ratelimit.WithShards(1),
+	)
+
+	return ratelimit.NewLimiter(p.Capacity, p.RefillRate, p.Interval, opts...)
+}
+
+// storeOptions returns the options that keep a limiter's state in the
+// shared store, if one is configured
+func (g *Gateway) storeOptions(prefix string) []ratelimit.Option {
+	if g.config.RateLimitStore == nil {
+		return nil
+	}
+
+	return []ratelimit.Option{
+		ratelimit.WithStore(g.config.RateLimitStore),
+		ratelimit.WithStorePrefix(prefix),
+	}
+}
+
+// checkpointOptions returns the options that checkpoint the per-client
+// limiter to the state file, if one is configured
+func (g *Gateway) checkpointOptions() []ratelimit.Option {
+	if g.config.RateLimitStateFile == "" {
+		return nil
+	}
+
+	return []ratelimit.Option{
+		ratelimit.WithCheckpoint(g.config.RateLimitStateFile, g.config.RateLimitCheckpointInterval, func(err error) {
+			log.Printf("Rate limit checkpoint failed: %v", err)
+		}),
+	}
+}
+
+// restoreState loads the per-client limiter's state file, if it exists
+func (g *Gateway) restoreState(l *ratelimit.Limiter) {
+	err := l.LoadFile(g.config.RateLimitStateFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Rate limit state not restored: %v", err)
+	}
+}
+
+// withRouteDefaults fills zero fields of a route or global policy
+func withRouteDefaults(p ratelimit.Policy) ratelimit.Policy {
+	if p.RefillRate == 0 {
+		p.RefillRate = p.Capacity
+	}
+	if p.Interval == 0 {
+		p.Interval = time.Second
+	}
+	return p
+}
+
+// AddRoute adds a new route to the gateway. Options can add route-level
+// rate limits, which a request must pass along with the gateway's limits.
+// Adding a path again replaces the route and its limits.
+func (g *Gateway) AddRoute(path string, backendURLs []string, opts ...RouteOption) error {
 	route := &Route{
 		Path:     path,
 		Backends: make([]*Backend, 0, len(backendURLs)),
 	}
+	for _, opt := range opts {
+		opt(route)
+	}
 
 	for _, backendURL := range backendURLs {
 		u, err := url.Parse(backendURL)
@@ -128,7 +353,7 @@ func (g *Gateway) AddRoute(path string, backendURLs []string) error {
 		}
 
 		proxy := httputil.NewSingleHostReverseProxy(u)
-		
+
 		// Customize error handler
 		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 			log.Printf("Gateway error: %v", err)
@@ -136,6 +361,10 @@ func (g *Gateway) AddRoute(path string, backendURLs []string) error {
 			fmt.Fprintf(w, `{"error":"bad gateway","message":"Backend service unavailable"}`)
 		}
 
+		if g.bandwidth != nil {
+			proxy.ModifyResponse = g.throttleResponse
+		}
+
 		backend := &Backend{
 			URL:          u,
 			Alive:        true,
@@ -145,19 +374,94 @@ func (g *Gateway) AddRoute(path string, backendURLs []string) error {
 		route.Backends = append(route.Backends, backend)
 	}
 
+	var levels []ratelimit.Level
+	if route.clientLimit.Capacity > 0 {
+		clientLimiter := g.newClientLimiter("route_client:"+path+":", withRouteDefaults(route.clientLimit))
+		route.owned = append(route.owned, clientLimiter)
+		levels = append(levels, ratelimit.Level{Name: "route_client", Limiter: clientLimiter})
+	}
+	if route.limit.Capacity > 0 {
+		routeLimiter := g.newSharedLimiter("route:", route.limit)
+		route.owned = append(route.owned, routeLimiter)
+		levels = append(levels, ratelimit.Level{
+			Name:    "route",
+			Limiter: routeLimiter,
+			Key:     ratelimit.StaticKey(path),
+		})
+	}
+	if route.aimd != nil {
+		route.adaptive = ratelimit.NewAdaptiveLimiter(*route.aimd, ratelimit.WithShards(1))
+		levels = append(levels, ratelimit.Level{
+			Name:    "adaptive",
+			Limiter: route.adaptive,
+			Key:     ratelimit.StaticKey(path),
+		})
+	}
+	route.limiter = ratelimit.NewComposite(append(levels, g.levels...)...)
+	route.handler = g.rateLimit(route.limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.proxy(route, w, r)
+	}))
+
+	g.mu.Lock()
+	old := g.routes[path]
 	g.routes[path] = route
+	g.mu.Unlock()
+
+	if old != nil {
+		old.stopLimiters()
+	}
 	return nil
 }
 
-// Handler returns the HTTP handler for the gateway
-func (g *Gateway) Handler() http.Handler {
-	rateLimitMiddleware := middleware.RateLimit(middleware.RateLimitConfig{
-		Limiter:             g.limiter,
-		KeyExtractor:        middleware.IPKeyExtractor,
+// stopLimiters stops the route's own limiters
+func (r *Route) stopLimiters() {
+	for _, l := range r.owned {
+		l.Stop()
+	}
+}
+
+// rateLimit wraps next with the gateway's rate limit middleware
+func (g *Gateway) rateLimit(limiter ratelimit.RateLimiter, next http.Handler) http.Handler {
+	return middleware.RateLimit(middleware.RateLimitConfig{
+		Limiter:             limiter,
+		KeyExtractor:        g.clientKey,
 		OnRateLimitExceeded: middleware.DefaultRateLimitHandler,
-	})
+	})(next)
+}
+
+// clientKey returns the key identifying the client of a request
+func (g *Gateway) clientKey(r *http.Request) string {
+	return g.clientIP.Key(r)
+}
+
+// clientKeyContextKey carries the client key from a request to its
+// proxied response
+type clientKeyContextKey struct{}
+
+// throttleResponse limits the rate at which a proxied response body is
+// read, and so sent on to the client, to the client's bandwidth
+func (g *Gateway) throttleResponse(resp *http.Response) error {
+	key, ok := resp.Request.Context().Value(clientKeyContextKey{}).(string)
+	if !ok {
+		return nil
+	}
+
+	resp.Body = throttledBody{
+		Reader: ratelimit.NewReader(resp.Request.Context(), resp.Body, g.bandwidth.Waiter(key)),
+		Closer: resp.Body,
+	}
+	return nil
+}
+
+// throttledBody is a response body read through a bandwidth limit
+type throttledBody struct {
+	io.Reader
+	io.Closer
+}
 
-	return rateLimitMiddleware(http.HandlerFunc(g.handleRequest))
+// Handler returns the HTTP handler for the gateway
+func (g *Gateway) Handler() http.Handler {
+	return http.HandlerFunc(g.handleRequest)
 }
 
 // handleRequest handles incoming requests
@@ -167,10 +471,15 @@ func (g *Gateway) handleRequest(w http.ResponseWriter, r *http.Request) {
 	g.mu.RUnlock()
 
 	if !exists {
-		http.NotFound(w, r)
+		g.notFound.ServeHTTP(w, r)
 		return
 	}
 
+	route.handler.ServeHTTP(w, r)
+}
+
+// proxy forwards a request that passed the rate limits to a route's backend
+func (g *Gateway) proxy(route *Route, w http.ResponseWriter, r *http.Request) {
 	backend := route.NextBackend()
 	if backend == nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -178,14 +487,72 @@ func (g *Gateway) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Proxy the request
-	backend.ReverseProxy.ServeHTTP(w, r)
+	if g.bandwidth != nil {
+		r = r.WithContext(context.WithValue(r.Context(), clientKeyContextKey{}, g.clientKey(r)))
+	}
+
+	if route.adaptive == nil {
+		// Proxy the request
+		backend.ReverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	// Proxy the request, reporting the backend's health to the adaptive limit
+	rec := &statusRecorder{ResponseWriter: w, start: time.Now()}
+	backend.ReverseProxy.ServeHTTP(rec, r)
+	route.adaptive.Observe(rec.latency(), rec.status >= http.StatusInternalServerError)
+}
+
+// statusRecorder records the status of a proxied response and how long the
+// backend took to start it
+type statusRecorder struct {
+	http.ResponseWriter
+	start    time.Time
+	status   int
+	duration time.Duration
+}
+
+// WriteHeader records the status and time to first byte
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+		s.duration = time.Since(s.start)
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Write records an implicit 200 status
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// latency returns the time to first byte, or the whole time if nothing was written
+func (s *statusRecorder) latency() time.Duration {
+	if s.status == 0 {
+		return time.Since(s.start)
+	}
+	return s.duration
 }
 
 // StartHealthCheck starts health checking for all backends
 func (g *Gateway) StartHealthCheck() {
 	ticker := time.NewTicker(g.healthCheck)
-	
+
 	go func() {
 		for {
 			select {
@@ -234,7 +601,7 @@ func (g *Gateway) isBackendAlive(u *url.URL) bool {
 	// Try /health endpoint first, fall back to root
 	healthURL := *u
 	healthURL.Path = "/health"
-	
+
 	req, err := http.NewRequestWithContext(ctx, "GET", healthURL.String(), nil)
 	if err != nil {
 		return false
@@ -252,6 +619,39 @@ func (g *Gateway) isBackendAlive(u *url.URL) bool {
 // Stop stops the gateway
 func (g *Gateway) Stop() {
 	g.cancel()
+	for _, l := range g.owned {
+		l.Stop()
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, route := range g.routes {
+		route.stopLimiters()
+	}
+}
+
+// UpdateRateLimit changes the per-client rate limit while the gateway runs.
+// Clients keep the same used share of their allowance. It fails if the
+// configured Limiter isn't a *ratelimit.Limiter.
+func (g *Gateway) UpdateRateLimit(capacity, refillRate int64, interval time.Duration) error {
+	limiter, ok := g.limiter.(*ratelimit.Limiter)
+	if !ok {
+		return fmt.Errorf("rate limiter %T can't be updated", g.limiter)
+	}
+
+	limiter.Update(capacity, refillRate, interval)
+	return nil
+}
+
+// InspectClient returns the per-client rate limit state of a client key,
+// such as an IP address. It returns false if the key isn't tracked or the
+// configured Limiter can't report it.
+func (g *Gateway) InspectClient(key string) (ratelimit.KeyInfo, bool) {
+	inspector, ok := g.limiter.(ratelimit.Inspector)
+	if !ok {
+		return ratelimit.KeyInfo{}, false
+	}
+	return inspector.Inspect(key)
 }
 
 // Stats returns gateway statistics
@@ -270,6 +670,7 @@ func (g *Gateway) Stats() map[string]interface{} {
 		routeStats[path] = map[string]interface{}{
 			"total_backends": len(route.Backends),
 			"alive_backends": aliveCount,
+			"rate_limit":     route.limiter.Stats(),
 		}
 	}
 
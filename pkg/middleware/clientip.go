@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPConfig configures a ClientIPExtractor
+type ClientIPConfig struct {
+	// TrustedProxies are the networks of the proxies in front of the
+	// server. Forwarding headers are only believed on requests arriving
+	// from one of them, and only as far back as the chain of trusted
+	// proxies goes. Empty means the peer address is always the client.
+	TrustedProxies []netip.Prefix
+
+	// IPv6Prefix keys IPv6 clients by their network of this many bits,
+	// such as 64 or 56, since one client usually holds a whole /64 and
+	// could otherwise get a fresh allowance from each address
+	// (0 keys each address)
+	IPv6Prefix int
+
+	// IPv4Prefix keys IPv4 clients by their network of this many bits,
+	// such as 24 (0 keys each address)
+	IPv4Prefix int
+}
+
+// ClientIPExtractor finds the address of the client behind any trusted
+// proxies. Unlike IPKeyExtractor, a client can't choose its own key by
+// sending a forwarding header: the header is walked from the right, where
+// each trusted proxy appended the address it saw, and the first address
+// that isn't a trusted proxy is the client.
+// Safe for concurrent use by multiple goroutines
+type ClientIPExtractor struct {
+	trusted    []netip.Prefix
+	ipv6Prefix int
+	ipv4Prefix int
+}
+
+// NewClientIPExtractor creates an extractor trusting config.TrustedProxies
+// and keying clients by the configured prefixes
+func NewClientIPExtractor(config ClientIPConfig) *ClientIPExtractor {
+	trusted := make([]netip.Prefix, len(config.TrustedProxies))
+	for i, p := range config.TrustedProxies {
+		trusted[i] = normalizePrefix(p)
+	}
+	return &ClientIPExtractor{
+		trusted:    trusted,
+		ipv6Prefix: config.IPv6Prefix,
+		ipv4Prefix: config.IPv4Prefix,
+	}
+}
+
+// ParseTrustedProxies parses CIDRs such as "10.0.0.0/8", or single
+// addresses, for ClientIPConfig.TrustedProxies
+func ParseTrustedProxies(cidrs ...string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// Key returns the client address as a rate limit key, or RemoteAddr as it
+// is if it isn't an IP address. With a prefix configured for the address
+// family, the key is the client's network instead, such as
+// "2001:db8:1:2::/64". Use it as a KeyExtractor.
+func (c *ClientIPExtractor) Key(r *http.Request) string {
+	addr, ok := c.ClientIP(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+
+	bits := c.ipv4Prefix
+	if addr.Is6() {
+		bits = c.ipv6Prefix
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+	return netip.PrefixFrom(addr, bits).Masked().String()
+}
+
+// ClientIP returns the address of the client that sent r, or false if the
+// peer address isn't an IP address. IPv4-mapped IPv6 addresses are
+// returned as IPv4, so a client has one key whichever way it connects.
+//
+// If the peer is a trusted proxy, the RFC 7239 Forwarded header is used,
+// or failing that X-Forwarded-For, or failing that X-Real-IP. Hops are
+// taken from the right until one isn't a trusted proxy. A hop that can't
+// be parsed, such as "unknown", ends the walk at the last trusted proxy,
+// so a client can't use it to escape its own address.
+func (c *ClientIPExtractor) ClientIP(r *http.Request) (netip.Addr, bool) {
+	client, ok := parseHop(r.RemoteAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if !c.isTrusted(client) {
+		return client, true
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		hops = splitList(r.Header.Values("X-Real-IP"))
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		client = hop
+		if !c.isTrusted(client) {
+			break
+		}
+	}
+	return client, true
+}
+
+// isTrusted reports whether addr belongs to a trusted proxy
+func (c *ClientIPExtractor) isTrusted(addr netip.Addr) bool {
+	for _, p := range c.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePrefix masks p and turns an IPv4-mapped prefix into IPv4, to
+// match the addresses ClientIP compares against it
+func normalizePrefix(p netip.Prefix) netip.Prefix {
+	if addr := p.Addr(); addr.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	return p.Masked()
+}
+
+// parseHop parses an address as it appears in RemoteAddr or a forwarding
+// header, with or without a port, brackets or quotes
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// splitList splits comma-separated header values into trimmed elements
+func splitList(values []string) []string {
+	var elems []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				elems = append(elems, elem)
+			}
+		}
+	}
+	return elems
+}
+
+// forwardedFor returns the for= parameter of each element of RFC 7239
+// Forwarded header values, in order. Elements without one are returned as
+// "" so they still count as a hop.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			if strings.TrimSpace(elem) == "" {
+				continue
+			}
+
+			hop := ""
+			for _, pair := range splitQuoted(elem, ';') {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(name), "for") {
+					hop = strings.TrimSpace(value)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s at sep, ignoring separators inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts   []string
+		start   int
+		quoted  bool
+		escaped bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPExtractor(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8", "2001:db8::/32", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor := NewClientIPExtractor(ClientIPConfig{TrustedProxies: trusted})
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:   "direct client",
+			remote: "203.0.113.7:1234",
+			want:   "203.0.113.7",
+		},
+		{
+			name:    "untrusted peer can't forge headers",
+			remote:  "203.0.113.7:1234",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "rightmost untrusted hop",
+			remote:  "10.0.0.2:443",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.9, 10.0.0.1"},
+			want:    "198.51.100.9",
+		},
+		{
+			name:    "all hops trusted",
+			remote:  "10.0.0.2:443",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.5, 10.0.0.1"},
+			want:    "10.0.0.5",
+		},
+		{
+			name:    "unparseable hop stops the walk",
+			remote:  "10.0.0.2:443",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.9, unknown, 10.0.0.1"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "hop with port",
+			remote:  "10.0.0.2:443",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.9:5555"},
+			want:    "198.51.100.9",
+		},
+		{
+			name:   "forwarded header",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"Forwarded":       `for=198.51.100.9;proto=https, for="[2001:db8::5]:8080";by=10.0.0.1`,
+				"X-Forwarded-For": "1.1.1.1",
+			},
+			want: "198.51.100.9",
+		},
+		{
+			name:    "forwarded IPv6 client",
+			remote:  "[2001:db8::1]:443",
+			headers: map[string]string{"Forwarded": `For="[2001:db9::42]:4711"`},
+			want:    "2001:db9::42",
+		},
+		{
+			name:    "forwarded obfuscated hop",
+			remote:  "10.0.0.2:443",
+			headers: map[string]string{"Forwarded": `for=198.51.100.9, for=_hidden`},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "x-real-ip",
+			remote:  "192.0.2.1:443",
+			headers: map[string]string{"X-Real-IP": "198.51.100.9"},
+			want:    "198.51.100.9",
+		},
+		{
+			name:   "ipv4-mapped peer",
+			remote: "[::ffff:203.0.113.7]:1234",
+			want:   "203.0.113.7",
+		},
+		{
+			name:    "ipv4-mapped proxy and hop",
+			remote:  "[::ffff:10.0.0.2]:443",
+			headers: map[string]string{"X-Forwarded-For": "::ffff:198.51.100.9"},
+			want:    "198.51.100.9",
+		},
+		{
+			name:   "not an IP",
+			remote: "@",
+			want:   "@",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			if got := extractor.Key(r); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8"} {
+		if _, err := ParseTrustedProxies(cidr); err == nil {
+			t.Errorf("Expected an error for %q", cidr)
+		}
+	}
+}
+
+func TestIPKeyExtractorFirstForwardedAddress(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "::ffff:1.2.3.4, 10.0.0.1")
+
+	if got := IPKeyExtractor(r); got != "1.2.3.4" {
+		t.Errorf("Expected the first forwarded address, got %s", got)
+	}
+}
+
+func TestClientIPExtractorPrefixes(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8")
+	extractor := NewClientIPExtractor(ClientIPConfig{
+		TrustedProxies: trusted,
+		IPv6Prefix:     56,
+		IPv4Prefix:     24,
+	})
+
+	tests := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		{remote: "[2001:db8:1:2:a:b:c:d]:443", want: "2001:db8:1::/56"},
+		{remote: "[2001:db8:1:ff::1]:443", want: "2001:db8:1::/56"},
+		{remote: "[2001:db8:1:100::1]:443", want: "2001:db8:1:100::/56"},
+		{remote: "198.51.100.9:443", want: "198.51.100.0/24"},
+		{remote: "[::ffff:198.51.100.200]:443", want: "198.51.100.0/24"},
+		{remote: "10.0.0.2:443", xff: "2001:db8:1:2::99", want: "2001:db8:1::/56"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+
+		if got := extractor.Key(r); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.remote, tt.want, got)
+		}
+	}
+
+	// Without prefixes each address is its own key
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8:1:2:a:b:c:d]:443"
+	if got := NewClientIPExtractor(ClientIPConfig{}).Key(r); got != "2001:db8:1:2:a:b:c:d" {
+		t.Errorf("Expected the full address, got %s", got)
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit"
+)
+
+// ConcurrencyLimitConfig configures the concurrency limiting middleware
+type ConcurrencyLimitConfig struct {
+	// Limiter caps in-flight requests per key
+	Limiter *ratelimit.ConcurrencyLimiter
+
+	// KeyExtractor extracts the key for concurrency limiting (defaults to IP-based)
+	KeyExtractor KeyExtractor
+
+	// OnLimitExceeded is called when no slot frees up in time
+	// Defaults to returning 429 Too Many Requests
+	OnLimitExceeded func(http.ResponseWriter, *http.Request)
+
+	// SkipFunc determines if concurrency limiting should be skipped for a request
+	SkipFunc func(*http.Request) bool
+}
+
+// ConcurrencyLimit returns HTTP middleware that caps in-flight requests per key.
+// The slot is released when the handler returns, including when it panics.
+func ConcurrencyLimit(config ConcurrencyLimitConfig) func(http.Handler) http.Handler {
+	// Set defaults
+	if config.KeyExtractor == nil {
+		config.KeyExtractor = IPKeyExtractor
+	}
+
+	if config.OnLimitExceeded == nil {
+		config.OnLimitExceeded = DefaultConcurrencyLimitHandler
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Skip concurrency limiting if configured
+			if config.SkipFunc != nil && config.SkipFunc(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Wait for a slot, giving up if the client goes away
+			key := config.KeyExtractor(r)
+			if err := config.Limiter.Acquire(r.Context(), key); err != nil {
+				config.OnLimitExceeded(w, r)
+				return
+			}
+			defer config.Limiter.Release(key)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DefaultConcurrencyLimitHandler returns a 429 response when too many requests are in flight
+func DefaultConcurrencyLimitHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, `{"error":"too many concurrent requests","message":"Too many requests in progress. Please try again later."}`)
+}
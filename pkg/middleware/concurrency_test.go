@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	limiter := ratelimit.NewConcurrencyLimiter(1, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	handler := ConcurrencyLimit(ConcurrencyLimitConfig{Limiter: limiter})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}),
+	)
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/slow", nil))
+	<-started
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/slow", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 while the slot is held, got %d", rec.Code)
+	}
+
+	close(release)
+}
+
+func TestConcurrencyLimitReleasesOnPanic(t *testing.T) {
+	limiter := ratelimit.NewConcurrencyLimiter(1, 0)
+
+	handler := ConcurrencyLimit(ConcurrencyLimitConfig{Limiter: limiter})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("handler failed")
+		}),
+	)
+
+	func() {
+		defer func() { recover() }()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+
+	if inFlight := limiter.Stats()["in_flight"]; inFlight != int64(0) {
+		t.Errorf("Expected the slot to be released after panic, got %v in flight", inFlight)
+	}
+}
@@ -0,0 +1,461 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit"
+)
+
+var (
+	// ErrTokenMissing is returned when a request has no bearer token
+	ErrTokenMissing = errors.New("middleware: missing bearer token")
+
+	// ErrTokenMalformed is returned when a token isn't a well-formed JWT
+	ErrTokenMalformed = errors.New("middleware: malformed token")
+
+	// ErrTokenUnverifiable is returned when no key in the key set can
+	// verify a token with its algorithm
+	ErrTokenUnverifiable = errors.New("middleware: no key to verify token")
+
+	// ErrTokenSignature is returned when a token's signature doesn't match
+	ErrTokenSignature = errors.New("middleware: invalid token signature")
+
+	// ErrTokenExpired is returned when a token's exp has passed
+	ErrTokenExpired = errors.New("middleware: token expired")
+
+	// ErrTokenNotYetValid is returned when a token's nbf hasn't arrived
+	ErrTokenNotYetValid = errors.New("middleware: token not valid yet")
+
+	// ErrTokenAudience is returned when a token isn't meant for any accepted audience
+	ErrTokenAudience = errors.New("middleware: token audience not accepted")
+)
+
+// Claims are the claims of a verified JWT
+type Claims map[string]interface{}
+
+// String returns a string claim, or false if it is missing or not a string
+func (c Claims) String(name string) (string, bool) {
+	s, ok := c[name].(string)
+	return s, ok
+}
+
+// Subject returns the sub claim
+func (c Claims) Subject() string {
+	s, _ := c.String("sub")
+	return s
+}
+
+// Audience returns the aud claim, which may be one string or a list
+func (c Claims) Audience() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		auds := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+		return auds
+	}
+	return nil
+}
+
+// maxClaimSeconds bounds NumericDate claims, about 35,000 years from 1970
+const maxClaimSeconds = 1 << 40
+
+// time returns a NumericDate claim, or false if it is missing or not a number
+func (c Claims) time(name string) (time.Time, bool) {
+	secs, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	// Keep absurd values far in the past or future rather than overflowing
+	secs = max(min(secs, maxClaimSeconds), -maxClaimSeconds)
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))), true
+}
+
+// claimsContextKey carries the verified claims in a request context
+type claimsContextKey struct{}
+
+// ClaimsFromContext returns the claims the JWT middleware verified for a
+// request, or false if the request had no valid token
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(Claims)
+	return claims, ok
+}
+
+// KeySet holds the keys tokens may be signed with. Each key accepts one
+// algorithm: HS256 for secrets, RS256 for RSA keys and ES256 for P-256
+// ECDSA keys, so a token can't pick a weaker check than its key demands.
+type KeySet struct {
+	keys []jwtKey
+}
+
+// jwtKey is one verification key
+type jwtKey struct {
+	id  string
+	alg string
+	key interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// NewKeySet creates an empty key set
+func NewKeySet() *KeySet {
+	return &KeySet{}
+}
+
+// AddHMAC adds a secret for HS256 tokens. kid may be empty for a key
+// that tokens don't name.
+func (ks *KeySet) AddHMAC(kid string, secret []byte) {
+	ks.keys = append(ks.keys, jwtKey{id: kid, alg: "HS256", key: secret})
+}
+
+// AddRSA adds a public key for RS256 tokens
+func (ks *KeySet) AddRSA(kid string, key *rsa.PublicKey) {
+	ks.keys = append(ks.keys, jwtKey{id: kid, alg: "RS256", key: key})
+}
+
+// AddECDSA adds a P-256 public key for ES256 tokens
+func (ks *KeySet) AddECDSA(kid string, key *ecdsa.PublicKey) {
+	ks.keys = append(ks.keys, jwtKey{id: kid, alg: "ES256", key: key})
+}
+
+// Len returns the number of keys in the set
+func (ks *KeySet) Len() int {
+	return len(ks.keys)
+}
+
+// jwk is a JSON Web Key as found in a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadJWKS reads a key set from a JWKS file
+func LoadJWKS(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// ParseJWKS parses a JWKS document ({"keys": [...]}). RSA, P-256 EC and
+// symmetric ("oct") keys are supported; keys meant for encryption rather
+// than signatures are skipped.
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	ks := NewKeySet()
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if err := ks.addJWK(k); err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %d (%q): %w", i, k.Kid, err)
+		}
+	}
+	return ks, nil
+}
+
+// addJWK adds a key from its JWK form
+func (ks *KeySet) addJWK(k jwk) error {
+	expect := map[string]string{"oct": "HS256", "RSA": "RS256", "EC": "ES256"}[k.Kty]
+	if expect == "" {
+		return fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	if k.Alg != "" && k.Alg != expect {
+		return fmt.Errorf("unsupported algorithm %q for key type %s", k.Alg, k.Kty)
+	}
+
+	switch k.Kty {
+	case "oct":
+		secret, err := decodeSegment(k.K)
+		if err != nil || len(secret) == 0 {
+			return errors.New("invalid k")
+		}
+		ks.AddHMAC(k.Kid, secret)
+
+	case "RSA":
+		n, errN := decodeSegment(k.N)
+		e, errE := decodeSegment(k.E)
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return errors.New("invalid n or e")
+		}
+		ks.AddRSA(k.Kid, &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		})
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := decodeSegment(k.X)
+		y, errY := decodeSegment(k.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return errors.New("invalid x or y")
+		}
+		// Parsing the uncompressed point checks that it is on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return errors.New("point is not on P-256")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		ks.AddECDSA(k.Kid, key)
+	}
+	return nil
+}
+
+// verify checks sig over signed with the keys matching kid and alg
+func (ks *KeySet) verify(kid, alg string, signed, sig []byte) error {
+	tried := false
+	for _, k := range ks.keys {
+		if k.alg != alg || (kid != "" && k.id != "" && k.id != kid) {
+			continue
+		}
+		tried = true
+		if verifySignature(k, signed, sig) {
+			return nil
+		}
+	}
+
+	if !tried {
+		return ErrTokenUnverifiable
+	}
+	return ErrTokenSignature
+}
+
+// verifySignature reports whether sig is k's signature over signed
+func verifySignature(k jwtKey, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// ES256 signatures are r and s as two 32-byte big-endian integers
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+// JWTConfig configures the JWT middleware
+type JWTConfig struct {
+	// Keys are the keys tokens may be signed with
+	Keys *KeySet
+
+	// Audience lists the accepted audiences; a token must name at least
+	// one of them in aud (empty skips the check)
+	Audience []string
+
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway time.Duration
+
+	// Optional lets requests without a token through unauthenticated, so
+	// later middleware can still limit them, such as by IP. Requests with
+	// an invalid token are rejected either way.
+	Optional bool
+
+	// OnError is called when a request is rejected
+	// Defaults to returning 401 Unauthorized
+	OnError func(http.ResponseWriter, *http.Request, error)
+
+	// Clock tells the time for exp and nbf (defaults to the system clock)
+	Clock ratelimit.Clock
+}
+
+// JWT returns HTTP middleware that verifies the request's bearer token and
+// puts its claims in the request context; see ClaimsFromContext
+func JWT(config JWTConfig) func(http.Handler) http.Handler {
+	if config.OnError == nil {
+		config.OnError = DefaultJWTErrorHandler
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := BearerToken(r)
+			if !ok {
+				if config.Optional {
+					next.ServeHTTP(w, r)
+					return
+				}
+				config.OnError(w, r, ErrTokenMissing)
+				return
+			}
+
+			claims, err := VerifyJWT(token, config)
+			if err != nil {
+				config.OnError(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+		})
+	}
+}
+
+// BearerToken returns the token from an "Authorization: Bearer" header,
+// whatever the case of the scheme
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// VerifyJWT verifies a compact JWT's signature against config.Keys and
+// checks its exp, nbf and aud claims, returning its claims if it is valid
+func VerifyJWT(token string, config JWTConfig) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSONSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	if config.Keys == nil {
+		return nil, ErrTokenUnverifiable
+	}
+	signed := []byte(token[:len(parts[0])+1+len(parts[1])])
+	if err := config.Keys.verify(header.Kid, header.Alg, signed, sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeJSONSegment(parts[1], &claims); err != nil || claims == nil {
+		return nil, ErrTokenMalformed
+	}
+
+	now := time.Now()
+	if config.Clock != nil {
+		now = config.Clock.Now()
+	}
+	if exp, ok := claims.time("exp"); ok && !now.Before(exp.Add(config.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Before(nbf.Add(-config.Leeway)) {
+		return nil, ErrTokenNotYetValid
+	}
+	if len(config.Audience) > 0 && !acceptsAudience(config.Audience, claims.Audience()) {
+		return nil, ErrTokenAudience
+	}
+
+	return claims, nil
+}
+
+// acceptsAudience reports whether any of the token's audiences is accepted
+func acceptsAudience(accepted, audiences []string) bool {
+	for _, aud := range audiences {
+		for _, a := range accepted {
+			if aud == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url segment, with or without padding
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// decodeJSONSegment decodes a base64url segment holding a JSON object into v
+func decodeJSONSegment(s string, v interface{}) error {
+	data, err := decodeSegment(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// DefaultJWTErrorHandler returns a 401 response when a token is missing or invalid
+func DefaultJWTErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, ErrTokenMissing) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, `{"error":"unauthorized","message":"A valid bearer token is required."}`)
+}
+
+// ClaimKeyExtractor keys requests by a claim of their verified token, such
+// as "sub" or a tenant claim, so each user or tenant has one allowance
+// however their token is written. Keys are prefixed with the claim name
+// ("sub:alice") so they can't collide with fallback keys. Requests without
+// the claim, or without a verified token, use fallback (defaults to
+// IP-based). Put the JWT middleware before the rate limit middleware.
+func ClaimKeyExtractor(claim string, fallback KeyExtractor) KeyExtractor {
+	if fallback == nil {
+		fallback = IPKeyExtractor
+	}
+
+	return func(r *http.Request) string {
+		if claims, ok := ClaimsFromContext(r.Context()); ok {
+			if value, ok := claims.String(claim); ok && value != "" {
+				return claim + ":" + value
+			}
+		}
+		return fallback(r)
+	}
+}
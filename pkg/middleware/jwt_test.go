@@ -0,0 +1,332 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit"
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit/ratelimittest"
+)
+
+var jwtTestTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// signToken builds a compact JWT signed with key under alg
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claimsValidAt returns claims for a token valid around jwtTestTime
+func claimsValidAt(extra map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": "alice",
+		"aud": []string{"api"},
+		"nbf": jwtTestTime.Add(-time.Minute).Unix(),
+		"exp": jwtTestTime.Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestVerifyJWTAlgorithms(t *testing.T) {
+	secret := []byte("s3cret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := NewKeySet()
+	keys.AddHMAC("hs", secret)
+	keys.AddRSA("rs", &rsaKey.PublicKey)
+	keys.AddECDSA("es", &ecKey.PublicKey)
+	config := JWTConfig{Keys: keys, Audience: []string{"api"}, Clock: ratelimittest.NewClock(jwtTestTime)}
+
+	for _, tt := range []struct {
+		alg string
+		kid string
+		key interface{}
+	}{
+		{"HS256", "hs", secret},
+		{"RS256", "rs", rsaKey},
+		{"ES256", "es", ecKey},
+		{"ES256", "", ecKey},
+	} {
+		token := signToken(t, tt.alg, tt.kid, tt.key, claimsValidAt(nil))
+		claims, err := VerifyJWT(token, config)
+		if err != nil {
+			t.Errorf("%s (kid %q): expected a valid token, got %v", tt.alg, tt.kid, err)
+			continue
+		}
+		if claims.Subject() != "alice" {
+			t.Errorf("%s: expected sub alice, got %q", tt.alg, claims.Subject())
+		}
+	}
+
+	// A token must be checked with the algorithm its key was added for
+	forged := signToken(t, "HS256", "rs", []byte("not the key"), claimsValidAt(nil))
+	if _, err := VerifyJWT(forged, config); !errors.Is(err, ErrTokenUnverifiable) {
+		t.Errorf("Expected ErrTokenUnverifiable for an HS256 token naming an RSA key, got %v", err)
+	}
+	wrongKey := signToken(t, "HS256", "hs", []byte("not the key"), claimsValidAt(nil))
+	if _, err := VerifyJWT(wrongKey, config); !errors.Is(err, ErrTokenSignature) {
+		t.Errorf("Expected ErrTokenSignature for a token signed with another secret, got %v", err)
+	}
+	none := signToken(t, "none", "", nil, claimsValidAt(nil))
+	if _, err := VerifyJWT(none, config); !errors.Is(err, ErrTokenUnverifiable) {
+		t.Errorf("Expected ErrTokenUnverifiable for alg none, got %v", err)
+	}
+}
+
+func TestVerifyJWTClaims(t *testing.T) {
+	secret := []byte("s3cret")
+	keys := NewKeySet()
+	keys.AddHMAC("", secret)
+	config := JWTConfig{Keys: keys, Audience: []string{"api"}, Clock: ratelimittest.NewClock(jwtTestTime)}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		leeway time.Duration
+		want   error
+	}{
+		{"valid", claimsValidAt(nil), 0, nil},
+		{"expired", claimsValidAt(map[string]interface{}{"exp": jwtTestTime.Add(-time.Second).Unix()}), 0, ErrTokenExpired},
+		{"expired within leeway", claimsValidAt(map[string]interface{}{"exp": jwtTestTime.Add(-time.Second).Unix()}), time.Minute, nil},
+		{"not yet valid", claimsValidAt(map[string]interface{}{"nbf": jwtTestTime.Add(time.Minute).Unix()}), 0, ErrTokenNotYetValid},
+		{"other audience", claimsValidAt(map[string]interface{}{"aud": "billing"}), 0, ErrTokenAudience},
+		{"audience string", claimsValidAt(map[string]interface{}{"aud": "api"}), 0, nil},
+		{"absurd exp", claimsValidAt(map[string]interface{}{"exp": 1e300}), 0, nil},
+	}
+
+	for _, tt := range tests {
+		config.Leeway = tt.leeway
+		token := signToken(t, "HS256", "", secret, tt.claims)
+		if _, err := VerifyJWT(token, config); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	valid := signToken(t, "HS256", "", secret, claimsValidAt(nil))
+	for name, token := range map[string]string{
+		"tampered":      valid[:len(valid)-2] + "AA",
+		"two segments":  "a.b",
+		"bad header":    "!!!." + valid[len("x."):],
+		"empty":         "",
+		"bad signature": valid + "%",
+	} {
+		if _, err := VerifyJWT(token, config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	coord := func(n *big.Int) string { return b64(n.FillBytes(make([]byte, 32))) }
+	doc, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": coord(ecKey.X), "y": coord(ecKey.Y), "use": "sig"},
+		{"kty": "RSA", "kid": "rsa1", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "oct", "kid": "hs1", "k": b64([]byte("s3cret"))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, doc, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatalf("LoadJWKS failed: %v", err)
+	}
+	if keys.Len() != 3 {
+		t.Errorf("Expected 3 signing keys, got %d", keys.Len())
+	}
+
+	config := JWTConfig{Keys: keys, Clock: ratelimittest.NewClock(jwtTestTime)}
+	for _, token := range []string{
+		signToken(t, "ES256", "ec1", ecKey, claimsValidAt(nil)),
+		signToken(t, "RS256", "rsa1", rsaKey, claimsValidAt(nil)),
+		signToken(t, "HS256", "hs1", []byte("s3cret"), claimsValidAt(nil)),
+	} {
+		if _, err := VerifyJWT(token, config); err != nil {
+			t.Errorf("Expected a token signed by a JWKS key to verify, got %v", err)
+		}
+	}
+
+	for name, bad := range map[string]string{
+		"curve":     `{"keys":[{"kty":"EC","crv":"P-384","x":"AA","y":"AA"}]}`,
+		"off curve": `{"keys":[{"kty":"EC","crv":"P-256","x":"` + coord(big.NewInt(1)) + `","y":"` + coord(big.NewInt(1)) + `"}]}`,
+		"alg":       `{"keys":[{"kty":"oct","alg":"RS256","k":"AQAB"}]}`,
+		"kty":       `{"keys":[{"kty":"OKP"}]}`,
+		"json":      `{"keys":`,
+	} {
+		if _, err := ParseJWKS([]byte(bad)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	secret := []byte("s3cret")
+	keys := NewKeySet()
+	keys.AddHMAC("", secret)
+	clock := ratelimittest.NewClock(jwtTestTime)
+
+	var gotClaims Claims
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotClaims, _ = ClaimsFromContext(r.Context())
+	})
+
+	tests := []struct {
+		name     string
+		optional bool
+		auth     string
+		code     int
+		sub      string
+	}{
+		{"missing", false, "", http.StatusUnauthorized, ""},
+		{"missing optional", true, "", http.StatusOK, ""},
+		{"valid", false, "Bearer " + signToken(t, "HS256", "", secret, claimsValidAt(nil)), http.StatusOK, "alice"},
+		{"lowercase scheme", false, "bearer " + signToken(t, "HS256", "", secret, claimsValidAt(nil)), http.StatusOK, "alice"},
+		{"invalid optional", true, "Bearer junk", http.StatusUnauthorized, ""},
+		{"basic", false, "Basic dXNlcjpwYXNz", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		gotClaims = nil
+		handler := JWT(JWTConfig{Keys: keys, Optional: tt.optional, Clock: clock})(next)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, rec.Code)
+		}
+		if gotClaims.Subject() != tt.sub {
+			t.Errorf("%s: expected sub %q in context, got %q", tt.name, tt.sub, gotClaims.Subject())
+		}
+		if tt.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate challenge", tt.name)
+		}
+	}
+}
+
+func TestClaimKeyExtractor(t *testing.T) {
+	secret := []byte("s3cret")
+	keys := NewKeySet()
+	keys.AddHMAC("", secret)
+
+	limiter := ratelimit.NewLimiter(1, 1, time.Hour)
+	handler := JWT(JWTConfig{Keys: keys, Optional: true, Clock: ratelimittest.NewClock(jwtTestTime)})(
+		RateLimit(RateLimitConfig{
+			Limiter:      limiter,
+			KeyExtractor: ClaimKeyExtractor("tenant", nil),
+		})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+	)
+
+	serve := func(auth string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	// Two users of one tenant share its allowance
+	alice := signToken(t, "HS256", "", secret, claimsValidAt(map[string]interface{}{"tenant": "acme"}))
+	bob := signToken(t, "HS256", "", secret, claimsValidAt(map[string]interface{}{"sub": "bob", "tenant": "acme"}))
+	if code := serve("Bearer " + alice); code != http.StatusOK {
+		t.Fatalf("Expected acme's first request to pass, got %d", code)
+	}
+	if code := serve("bearer " + bob); code != http.StatusTooManyRequests {
+		t.Errorf("Expected acme's second request to be limited, got %d", code)
+	}
+
+	// Anonymous requests fall back to the client IP, apart from tenants
+	if code := serve(""); code != http.StatusOK {
+		t.Errorf("Expected an anonymous request to have its own allowance, got %d", code)
+	}
+
+	if _, ok := limiter.Inspect("tenant:acme"); !ok {
+		t.Error("Expected the tenant key to be prefixed with the claim name")
+	}
+}
+
+func TestAPIKeyExtractorNormalisesScheme(t *testing.T) {
+	a := httptest.NewRequest("GET", "/", nil)
+	a.Header.Set("Authorization", "Bearer x")
+	b := httptest.NewRequest("GET", "/", nil)
+	b.Header.Set("Authorization", "bearer  x ")
+
+	if APIKeyExtractor(a) != APIKeyExtractor(b) {
+		t.Errorf("Expected one key, got %q and %q", APIKeyExtractor(a), APIKeyExtractor(b))
+	}
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxKeyValue is how long a key part's value may be before it is hashed
+const defaultMaxKeyValue = 64
+
+// KeyBuilder declares a KeyExtractor made of parts of the request, such as
+// a tenant header and the route, instead of coding one by hand:
+//
+//	extractor := middleware.NewKeyBuilder().
+//		Header("X-Tenant-ID").
+//		Route().
+//		Fallback(middleware.IPKeyExtractor).
+//		Build()
+//
+// Keys name each part, as in "x-tenant-id=acme|route=GET /orders/{id}".
+// A request missing any part is keyed by the first fallback instead.
+type KeyBuilder struct {
+	parts     []keyPart
+	fallbacks []KeyExtractor
+	maxValue  int
+}
+
+// keyPart is one named component of a built key
+type keyPart struct {
+	name  string
+	value func(*http.Request) string // "" when the request doesn't have it
+}
+
+// NewKeyBuilder creates an empty builder. Values longer than 64 bytes are
+// hashed unless MaxValueLength says otherwise.
+func NewKeyBuilder() *KeyBuilder {
+	return &KeyBuilder{maxValue: defaultMaxKeyValue}
+}
+
+// Header adds the value of a request header
+func (b *KeyBuilder) Header(name string) *KeyBuilder {
+	return b.Part(strings.ToLower(name), func(r *http.Request) string {
+		return strings.TrimSpace(r.Header.Get(name))
+	})
+}
+
+// Query adds the value of a query parameter
+func (b *KeyBuilder) Query(name string) *KeyBuilder {
+	return b.Part("query."+name, func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	})
+}
+
+// Cookie adds the value of a cookie
+func (b *KeyBuilder) Cookie(name string) *KeyBuilder {
+	return b.Part("cookie."+name, func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	})
+}
+
+// Method adds the request method
+func (b *KeyBuilder) Method() *KeyBuilder {
+	return b.Part("method", func(r *http.Request) string {
+		return r.Method
+	})
+}
+
+// Route adds the http.ServeMux pattern that matched the request, such as
+// "GET /orders/{id}", so every order shares one key. Requests not routed
+// by a ServeMux use their path.
+func (b *KeyBuilder) Route() *KeyBuilder {
+	return b.Part("route", func(r *http.Request) string {
+		if r.Pattern != "" {
+			return r.Pattern
+		}
+		return r.URL.Path
+	})
+}
+
+// ClientIP adds the client address found by extractor. A nil extractor
+// keys by the peer address and trusts no forwarding headers.
+func (b *KeyBuilder) ClientIP(extractor *ClientIPExtractor) *KeyBuilder {
+	if extractor == nil {
+		extractor = NewClientIPExtractor(ClientIPConfig{})
+	}
+	return b.Part("ip", extractor.Key)
+}
+
+// Claim adds a string claim of the token verified by the JWT middleware
+func (b *KeyBuilder) Claim(name string) *KeyBuilder {
+	return b.Part("claim."+name, func(r *http.Request) string {
+		claims, _ := ClaimsFromContext(r.Context())
+		value, _ := claims.String(name)
+		return value
+	})
+}
+
+// Part adds a custom part named name. value returns "" for requests that
+// don't have the part.
+func (b *KeyBuilder) Part(name string, value func(*http.Request) string) *KeyBuilder {
+	b.parts = append(b.parts, keyPart{name: name, value: value})
+	return b
+}
+
+// Fallback adds extractors to try, in order, for requests missing a part.
+// Another builder's Build makes a fallback with different parts, such as
+// the client IP and the route. Without fallbacks, such requests are keyed
+// by IPKeyExtractor.
+func (b *KeyBuilder) Fallback(extractors ...KeyExtractor) *KeyBuilder {
+	b.fallbacks = append(b.fallbacks, extractors...)
+	return b
+}
+
+// MaxValueLength sets how long a part's value may be before it is replaced
+// by a hash, so clients can't make keys arbitrarily large. 0 or less keeps
+// values as they are.
+func (b *KeyBuilder) MaxValueLength(n int) *KeyBuilder {
+	b.maxValue = n
+	return b
+}
+
+// Build returns the KeyExtractor. Changing the builder afterwards doesn't
+// affect it.
+func (b *KeyBuilder) Build() KeyExtractor {
+	parts := append([]keyPart(nil), b.parts...)
+	fallbacks := append([]KeyExtractor(nil), b.fallbacks...)
+	if len(fallbacks) == 0 {
+		fallbacks = []KeyExtractor{IPKeyExtractor}
+	}
+	maxValue := b.maxValue
+
+	return func(r *http.Request) string {
+		var key strings.Builder
+		for i, part := range parts {
+			value := part.value(r)
+			if value == "" {
+				return firstKey(fallbacks, r)
+			}
+
+			if i > 0 {
+				key.WriteByte('|')
+			}
+			key.WriteString(part.name)
+			key.WriteByte('=')
+			key.WriteString(keyValue(value, maxValue))
+		}
+		return key.String()
+	}
+}
+
+// firstKey returns the first non-empty key from extractors
+func firstKey(extractors []KeyExtractor, r *http.Request) string {
+	for _, extract := range extractors {
+		if key := extract(r); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// keyValueEscaper escapes the characters that separate key parts
+var keyValueEscaper = strings.NewReplacer("%", "%25", "|", "%7C")
+
+// keyValue returns value as it appears in a key: hashed if it is longer
+// than maxValue, and otherwise escaped so it can't forge another part
+func keyValue(value string, maxValue int) string {
+	if maxValue > 0 && len(value) > maxValue {
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:16])
+	}
+	return keyValueEscaper.Replace(value)
+}
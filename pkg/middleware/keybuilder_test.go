@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKeyBuilder(t *testing.T) {
+	extractor := NewKeyBuilder().
+		Header("X-Tenant-ID").
+		Method().
+		Query("region").
+		Cookie("session").
+		Build()
+
+	r := httptest.NewRequest("POST", "/orders?region=eu", nil)
+	r.Header.Set("X-Tenant-ID", "acme")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	want := "x-tenant-id=acme|method=POST|query.region=eu|cookie.session=abc"
+	if got := extractor(r); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// A missing part falls back to the client IP
+	r.Header.Del("X-Tenant-ID")
+	if got := extractor(r); got != "192.0.2.1" {
+		t.Errorf("Expected the IP fallback, got %s", got)
+	}
+}
+
+func TestKeyBuilderRouteWithFallback(t *testing.T) {
+	// Tenant and route, falling back to IP and route
+	extractor := NewKeyBuilder().
+		Header("X-Tenant-ID").
+		Route().
+		Fallback(NewKeyBuilder().ClientIP(nil).Route().Build()).
+		Build()
+
+	var keys []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, extractor(r))
+	})
+
+	for _, tenant := range []string{"acme", ""} {
+		r := httptest.NewRequest("GET", "/orders/42", nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant-ID", tenant)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	want := []string{"x-tenant-id=acme|route=GET /orders/{id}", "ip=192.0.2.1|route=GET /orders/{id}"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v, got %v", want, keys)
+	}
+}
+
+func TestKeyBuilderClientIPIgnoresForwarding(t *testing.T) {
+	extractor := NewKeyBuilder().ClientIP(nil).Build()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("X-Real-IP", "203.0.113.8")
+	if got, want := extractor(r), "ip=192.0.2.1"; got != want {
+		t.Errorf("Expected the peer address %s, got %s", want, got)
+	}
+}
+
+func TestKeyBuilderValues(t *testing.T) {
+	extractor := NewKeyBuilder().Header("X-Tenant-ID").Route().Build()
+
+	// A value can't forge another part
+	r := httptest.NewRequest("GET", "/a", nil)
+	r.Header.Set("X-Tenant-ID", "acme|route=/b")
+	if got, want := extractor(r), "x-tenant-id=acme%7Croute=/b|route=/a"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// Long values are hashed to a fixed length
+	long := strings.Repeat("x", 1000)
+	r.Header.Set("X-Tenant-ID", long)
+	key := extractor(r)
+	if len(key) > 100 || !strings.Contains(key, "sha256:") {
+		t.Errorf("Expected a hashed value, got %s", key)
+	}
+	r.Header.Set("X-Tenant-ID", long+"y")
+	if extractor(r) == key {
+		t.Error("Expected different long values to hash differently")
+	}
+
+	unhashed := NewKeyBuilder().Header("X-Tenant-ID").MaxValueLength(0).Build()
+	if got := unhashed(r); !strings.Contains(got, long) {
+		t.Error("Expected the value to be kept with hashing disabled")
+	}
+}
+
+func TestKeyBuilderClaim(t *testing.T) {
+	extractor := NewKeyBuilder().
+		Claim("tenant").
+		Fallback(func(r *http.Request) string { return "anonymous" }).
+		Build()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if got := extractor(r); got != "anonymous" {
+		t.Errorf("Expected the fallback without claims, got %s", got)
+	}
+}
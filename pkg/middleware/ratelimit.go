@@ -1,9 +1,12 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"log"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/manuelondina/goroutine-3000/pkg/ratelimit"
@@ -15,7 +18,7 @@ type KeyExtractor func(*http.Request) string
 // RateLimitConfig configures the rate limiting middleware
 type RateLimitConfig struct {
 	// Limiter is the rate limiter to use
-	Limiter *ratelimit.Limiter
+	Limiter ratelimit.RateLimiter
 
 	// KeyExtractor extracts the key for rate limiting (defaults to IP-based)
 	KeyExtractor KeyExtractor
@@ -26,6 +29,43 @@ type RateLimitConfig struct {
 
 	// SkipFunc determines if rate limiting should be skipped for a request
 	SkipFunc func(*http.Request) bool
+
+	// Quota, when set, adds quota headers to every response. It should also
+	// be one of the Limiter's levels, usually the last in a Composite.
+	Quota *ratelimit.Quota
+
+	// IETFHeaders adds the RateLimit and RateLimit-Policy fields from the
+	// IETF draft alongside the X-RateLimit headers
+	IETFHeaders bool
+
+	// MaxWait, when set, holds a request the limiter rejects for up to this
+	// long until it is allowed, instead of rejecting it at once. Requests
+	// that can't be allowed in time, including those whose Quota is used up
+	// until after MaxWait, are rejected without waiting.
+	MaxWait time.Duration
+
+	// MaxQueue bounds how many requests MaxWait holds at once; requests
+	// beyond it are rejected (0 means unlimited)
+	MaxQueue int
+
+	// Clock tells the time for MaxWait and Retry-After (defaults to the
+	// system clock). It should be the clock the Limiter uses.
+	Clock ratelimit.Clock
+
+	// DryRun checks the limiter but never rejects, so a new policy can be
+	// measured in production before it is enforced. No rate limit headers
+	// are added, and requests that would have been rejected are counted
+	// in DryRunRejections and passed to OnDryRunReject.
+	DryRun bool
+
+	// DryRunRejections, when set, counts the requests DryRun let through
+	// that would have been rejected
+	DryRunRejections *atomic.Uint64
+
+	// OnDryRunReject is called for each request DryRun let through that
+	// would have been rejected
+	// Defaults to logging it
+	OnDryRunReject func(r *http.Request, key string)
 }
 
 // RateLimit returns HTTP middleware that applies rate limiting
@@ -39,6 +79,19 @@ func RateLimit(config RateLimitConfig) func(http.Handler) http.Handler {
 		config.OnRateLimitExceeded = DefaultRateLimitHandler
 	}
 
+	if config.OnDryRunReject == nil {
+		config.OnDryRunReject = logDryRunReject
+	}
+
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+
+	var queue chan struct{}
+	if config.MaxWait > 0 && config.MaxQueue > 0 {
+		queue = make(chan struct{}, config.MaxQueue)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Skip rate limiting if configured
@@ -49,50 +102,202 @@ func RateLimit(config RateLimitConfig) func(http.Handler) http.Handler {
 
 			// Extract key and check rate limit
 			key := config.KeyExtractor(r)
-			if !config.Limiter.Allow(key) {
-				config.OnRateLimitExceeded(w, r)
+			allowed := config.Limiter.Allow(key)
+
+			if config.DryRun {
+				if !allowed {
+					if config.DryRunRejections != nil {
+						config.DryRunRejections.Add(1)
+					}
+					config.OnDryRunReject(r, key)
+				}
+				next.ServeHTTP(w, r)
 				return
 			}
 
-			// Add rate limit headers
-			AddRateLimitHeaders(w, config.Limiter, key)
+			if !allowed && config.MaxWait > 0 {
+				deadline := config.Clock.Now().Add(config.MaxWait)
+				if !quotaExhausted(config.Quota, key, deadline) {
+					allowed = waitForLimit(r.Context(), config.Clock, config.Limiter, key, config.MaxWait, queue)
+				}
+			}
+
+			if config.Quota != nil {
+				AddQuotaHeaders(w, config.Quota, key)
+			}
+
+			// Add rate limit headers, all as of one instant so they agree
+			now := config.Clock.Now()
+			addRateLimitHeaders(w, config.Limiter, key, now)
+			if config.IETFHeaders {
+				addIETFRateLimitHeaders(w, config.Limiter, key, now)
+			}
+
+			if !allowed {
+				retryAfter := retryAfter(config.Limiter, key, now)
+				if config.Quota != nil {
+					if usage := config.Quota.Usage(key); usage.Remaining == 0 {
+						retryAfter = max(retryAfter, usage.ResetAt.Sub(now))
+					}
+				}
+				setRetryAfter(w, retryAfter)
+				config.OnRateLimitExceeded(w, r)
+				return
+			}
 
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// IPKeyExtractor extracts the client IP address as the rate limit key
+// waitForLimit waits up to maxWait, as measured by clock, for the limiter
+// to allow a request for key, taking a place in queue while it does if
+// queue is set. It reports false if the queue is full, the request can't
+// be allowed in time, or ctx is done first.
+func waitForLimit(ctx context.Context, clock ratelimit.Clock, limiter ratelimit.RateLimiter, key string, maxWait time.Duration, queue chan struct{}) bool {
+	if queue != nil {
+		select {
+		case queue <- struct{}{}:
+			defer func() { <-queue }()
+		default:
+			return false
+		}
+	}
+
+	ctx, cancel := withClockTimeout(ctx, clock, maxWait)
+	defer cancel()
+
+	if kw, ok := limiter.(ratelimit.KeyWaiter); ok {
+		return kw.WaitN(ctx, key, 1) == nil
+	}
+
+	// Other limiters are retried when they say a request should be allowed
+	deadline, _ := ctx.Deadline()
+	for {
+		now := clock.Now()
+		delay := retryAfter(limiter, key, now)
+		if deadline.Sub(now) < delay {
+			return false
+		}
+
+		select {
+		case <-clock.After(max(delay, minRetryInterval)):
+		case <-ctx.Done():
+			return false
+		}
+
+		if limiter.Allow(key) {
+			return true
+		}
+	}
+}
+
+// minRetryInterval spaces out retries for limiters that report no delay,
+// such as one rejecting for another key's sake
+const minRetryInterval = 10 * time.Millisecond
+
+// quotaExhausted reports whether key has used up its quota until after
+// deadline, so there is no point waiting for the other limits
+func quotaExhausted(quota *ratelimit.Quota, key string, deadline time.Time) bool {
+	if quota == nil {
+		return false
+	}
+	usage := quota.Usage(key)
+	return usage.Remaining == 0 && usage.ResetAt.After(deadline)
+}
+
+// clockContext is a context whose deadline is told by a ratelimit.Clock,
+// so limiters using the same clock can tell whether they can wait for it
+type clockContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c clockContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+// withClockTimeout returns a copy of ctx that is done once clock has moved
+// on by d, or when the returned cancel function is called
+func withClockTimeout(ctx context.Context, clock ratelimit.Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	deadline := clock.Now().Add(d)
+	if parent, ok := ctx.Deadline(); ok && parent.Before(deadline) {
+		deadline = parent
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	timeout := clock.After(d)
+	go func() {
+		select {
+		case <-timeout:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return clockContext{Context: ctx, deadline: deadline}, cancel
+}
+
+// systemClock is the ratelimit.Clock backed by the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// logDryRunReject logs a request a dry run would have rejected
+func logDryRunReject(r *http.Request, key string) {
+	log.Printf("Rate limit dry run: would reject %s %s for key %s", r.Method, r.URL.Path, key)
+}
+
+// IPKeyExtractor extracts the client IP address as the rate limit key.
+// It believes X-Forwarded-For and X-Real-IP from anyone, so a client that
+// reaches the server directly can pick its own key; use a
+// ClientIPExtractor with the proxies you trust instead.
 func IPKeyExtractor(r *http.Request) string {
 	// Try X-Forwarded-For header first (for proxied requests)
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		// Take the first IP in the list
-		if host, _, err := net.SplitHostPort(xff); err == nil {
-			return host
+		first, _, _ := strings.Cut(xff, ",")
+		if addr, ok := parseHop(first); ok {
+			return addr.String()
 		}
-		return xff
+		return strings.TrimSpace(first)
 	}
 
 	// Try X-Real-IP header
 	if xri := r.Header.Get("X-Real-IP"); xri != "" {
+		if addr, ok := parseHop(xri); ok {
+			return addr.String()
+		}
 		return xri
 	}
 
 	// Fall back to RemoteAddr
-	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		return host
+	if addr, ok := parseHop(r.RemoteAddr); ok {
+		return addr.String()
 	}
 
 	return r.RemoteAddr
 }
 
-// APIKeyExtractor extracts an API key from the Authorization header
+// APIKeyExtractor extracts an API key from the Authorization header. It
+// doesn't check the key, so any value gets its own allowance; use the JWT
+// middleware with a ClaimKeyExtractor to key by verified identity.
 func APIKeyExtractor(r *http.Request) string {
-	apiKey := r.Header.Get("Authorization")
+	apiKey := strings.TrimSpace(r.Header.Get("Authorization"))
 	if apiKey == "" {
 		// Fall back to IP-based limiting if no API key
 		return IPKeyExtractor(r)
 	}
+
+	// Normalise the scheme, so "Bearer x" and "bearer x" are one client
+	if scheme, credentials, ok := strings.Cut(apiKey, " "); ok {
+		apiKey = strings.ToLower(scheme) + " " + strings.TrimSpace(credentials)
+	}
 	return apiKey
 }
 
@@ -109,11 +314,115 @@ func DefaultRateLimitHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `{"error":"rate limit exceeded","message":"Too many requests. Please try again later."}`)
 }
 
-// AddRateLimitHeaders adds standard rate limit headers to the response
-func AddRateLimitHeaders(w http.ResponseWriter, limiter *ratelimit.Limiter, key string) {
-	stats := limiter.Stats()
-	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", stats["capacity"]))
-	w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(time.Duration(stats["interval_ms"].(int64))*time.Millisecond).Unix()))
+// AddRateLimitHeaders adds the key's limit, remaining requests and the time
+// its allowance is full again (in Unix seconds) to the response. Limiters
+// that don't implement ratelimit.Inspector only report their default
+// capacity, and a reset one interval from now.
+func AddRateLimitHeaders(w http.ResponseWriter, limiter ratelimit.RateLimiter, key string) {
+	addRateLimitHeaders(w, limiter, key, time.Now())
+}
+
+// addRateLimitHeaders is AddRateLimitHeaders as of now
+func addRateLimitHeaders(w http.ResponseWriter, limiter ratelimit.RateLimiter, key string, now time.Time) {
+	info, ok := inspect(limiter, key)
+	if !ok {
+		stats := limiter.Stats()
+		if capacity, ok := stats["capacity"]; ok {
+			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", capacity))
+		}
+		if intervalMs, ok := stats["interval_ms"].(int64); ok {
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", now.Add(time.Duration(intervalMs)*time.Millisecond).Unix()))
+		}
+		return
+	}
+
+	resetAt := info.ResetAt
+	if resetAt.IsZero() {
+		resetAt = now
+	}
+	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", info.Capacity))
+	w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", info.Remaining))
+	w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", resetAt.Unix()))
+}
+
+// AddIETFRateLimitHeaders adds the RateLimit-Policy and RateLimit fields
+// defined by the IETF httpapi working group's rate limit headers draft:
+// the key's quota and window, and its remaining requests and the seconds
+// until its allowance is full again. Limiters that don't implement
+// ratelimit.Inspector add nothing.
+func AddIETFRateLimitHeaders(w http.ResponseWriter, limiter ratelimit.RateLimiter, key string) {
+	addIETFRateLimitHeaders(w, limiter, key, time.Now())
+}
+
+// addIETFRateLimitHeaders is AddIETFRateLimitHeaders as of now
+func addIETFRateLimitHeaders(w http.ResponseWriter, limiter ratelimit.RateLimiter, key string, now time.Time) {
+	info, ok := inspect(limiter, key)
+	if !ok {
+		return
+	}
+
+	name := info.Policy.Name
+	if name == "" {
+		name = "default"
+	}
+
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%q;q=%d;w=%d", name, info.Capacity, seconds(info.Policy.Window())))
+	w.Header().Set("RateLimit", fmt.Sprintf("%q;r=%d;t=%d", name, info.Remaining, seconds(info.ResetAt.Sub(now))))
+}
+
+// RetryAfter returns how long until the key's next request would be
+// allowed, or 0 if it would be allowed now. Limiters that don't implement
+// ratelimit.Inspector are assumed to free up within their refill interval.
+func RetryAfter(limiter ratelimit.RateLimiter, key string) time.Duration {
+	return retryAfter(limiter, key, time.Now())
+}
+
+// retryAfter is RetryAfter as of now
+func retryAfter(limiter ratelimit.RateLimiter, key string, now time.Time) time.Duration {
+	info, ok := inspect(limiter, key)
+	if !ok {
+		if intervalMs, ok := limiter.Stats()["interval_ms"].(int64); ok {
+			return time.Duration(intervalMs) * time.Millisecond
+		}
+		return 0
+	}
+
+	if info.Remaining > 0 || info.NextRefill.IsZero() {
+		return 0
+	}
+	return max(info.NextRefill.Sub(now), 0)
+}
+
+// setRetryAfter sets the Retry-After header to d in whole seconds,
+// rounded up and at least one, since a rejected client must wait
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", max(seconds(d), 1)))
+}
+
+// inspect returns the key's state if the limiter can report it
+func inspect(limiter ratelimit.RateLimiter, key string) (ratelimit.KeyInfo, bool) {
+	in, ok := limiter.(ratelimit.Inspector)
+	if !ok {
+		return ratelimit.KeyInfo{}, false
+	}
+	return in.Inspect(key)
+}
+
+// seconds returns d in whole seconds, rounded up and never negative
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// AddQuotaHeaders adds the key's quota limit, remaining requests and the
+// time the quota resets (in Unix seconds) to the response
+func AddQuotaHeaders(w http.ResponseWriter, quota *ratelimit.Quota, key string) {
+	usage := quota.Usage(key)
+	w.Header().Set("X-Quota-Limit", fmt.Sprintf("%d", usage.Limit))
+	w.Header().Set("X-Quota-Remaining", fmt.Sprintf("%d", usage.Remaining))
+	w.Header().Set("X-Quota-Reset", fmt.Sprintf("%d", usage.ResetAt.Unix()))
 }
 
 // NewDefaultConfig creates a rate limit config with sensible defaults
@@ -0,0 +1,352 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit"
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit/ratelimittest"
+)
+
+func TestRateLimitQuotaHeaders(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC))
+	quota := ratelimit.NewQuota(2, ratelimit.QuotaMonthly, ratelimit.WithClock(clock))
+	burst := ratelimit.NewLimiter(10, 10, time.Second, ratelimit.WithClock(clock))
+
+	handler := RateLimit(RateLimitConfig{
+		Limiter: ratelimit.NewComposite(
+			ratelimit.Level{Name: "burst", Limiter: burst},
+			ratelimit.Level{Name: "quota", Limiter: quota},
+		),
+		Quota: quota,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	reset := "1706745600" // 2024-02-01T00:00:00Z
+	for i, want := range []struct {
+		code      int
+		remaining string
+	}{
+		{http.StatusOK, "1"},
+		{http.StatusOK, "0"},
+		{http.StatusTooManyRequests, "0"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if rec.Code != want.code {
+			t.Errorf("Request %d: expected %d, got %d", i, want.code, rec.Code)
+		}
+		if got := rec.Header().Get("X-Quota-Remaining"); got != want.remaining {
+			t.Errorf("Request %d: expected %s remaining, got %s", i, want.remaining, got)
+		}
+		if got := rec.Header().Get("X-Quota-Limit"); got != "2" {
+			t.Errorf("Request %d: expected a limit of 2, got %s", i, got)
+		}
+		if got := rec.Header().Get("X-Quota-Reset"); got != reset {
+			t.Errorf("Request %d: expected reset %s, got %s", i, reset, got)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	for name, limiter := range map[string]*ratelimit.Limiter{
+		"local": ratelimit.NewLimiter(2, 1, time.Hour),
+		"store": ratelimit.NewLimiter(2, 1, time.Hour, ratelimit.WithStore(ratelimit.NewMemoryStore())),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testRateLimitHeaders(t, limiter)
+		})
+	}
+}
+
+func testRateLimitHeaders(t *testing.T, limiter ratelimit.RateLimiter) {
+	handler := RateLimit(RateLimitConfig{
+		Limiter: limiter,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []struct {
+		code       int
+		remaining  string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", ""},
+		{http.StatusOK, "0", ""},
+		{http.StatusTooManyRequests, "0", "3600"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if rec.Code != want.code {
+			t.Errorf("Request %d: expected %d, got %d", i, want.code, rec.Code)
+		}
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("Request %d: expected a limit of 2, got %s", i, got)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != want.remaining {
+			t.Errorf("Request %d: expected %s remaining, got %s", i, want.remaining, got)
+		}
+		if got := rec.Header().Get("Retry-After"); got != want.retryAfter {
+			t.Errorf("Request %d: expected Retry-After %q, got %q", i, want.retryAfter, got)
+		}
+	}
+
+	// Both requests come back one hour apart, so the bucket is full in two
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	reset, err := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		t.Fatalf("Expected a Unix reset time: %v", err)
+	}
+	if want := time.Now().Add(2 * time.Hour).Unix(); reset < want-2 || reset > want {
+		t.Errorf("Expected a reset around %d, got %d", want, reset)
+	}
+}
+
+func TestRateLimitHeadersAgreeOnClock(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := RateLimit(RateLimitConfig{
+		Limiter:     ratelimit.NewLimiter(1, 1, time.Minute, ratelimit.WithClock(clock)),
+		IETFHeaders: true,
+		Clock:       clock,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", rec.Code)
+	}
+	if want := strconv.FormatInt(clock.Now().Add(time.Minute).Unix(), 10); rec.Header().Get("X-RateLimit-Reset") != want {
+		t.Errorf("Expected X-RateLimit-Reset %s, got %s", want, rec.Header().Get("X-RateLimit-Reset"))
+	}
+	if got := rec.Header().Get("RateLimit"); got != `"default";r=0;t=60` {
+		t.Errorf("Expected the reset 60s away, got %s", got)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Expected Retry-After 60, got %s", got)
+	}
+}
+
+func TestRateLimitIETFHeaders(t *testing.T) {
+	handler := RateLimit(RateLimitConfig{
+		Limiter:     ratelimit.NewLimiter(10, 10, time.Minute),
+		IETFHeaders: true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if got, want := rec.Header().Get("RateLimit-Policy"), `"default";q=10;w=60`; got != want {
+		t.Errorf("Expected RateLimit-Policy %s, got %s", want, got)
+	}
+	if got, want := rec.Header().Get("RateLimit"), `"default";r=9;t=60`; got != want {
+		t.Errorf("Expected RateLimit %s, got %s", want, got)
+	}
+}
+
+func TestRateLimitRetryAfterQuota(t *testing.T) {
+	quota := ratelimit.NewQuota(1, ratelimit.QuotaDaily)
+	handler := RateLimit(RateLimitConfig{
+		Limiter: ratelimit.NewComposite(
+			ratelimit.Level{Name: "burst", Limiter: ratelimit.NewLimiter(10, 10, time.Second)},
+			ratelimit.Level{Name: "quota", Limiter: quota},
+		),
+		Quota: quota,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	// The burst level has room, so the client must wait for the quota
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("Expected Retry-After in seconds: %v", err)
+	}
+	if want := int(time.Until(quota.Usage("192.0.2.1").ResetAt).Seconds()); retryAfter < want || retryAfter > want+1 {
+		t.Errorf("Expected Retry-After of about %ds until the quota resets, got %d", want, retryAfter)
+	}
+}
+
+func TestRateLimitDryRun(t *testing.T) {
+	var (
+		rejections atomic.Uint64
+		rejected   []string
+		served     int
+	)
+	handler := RateLimit(RateLimitConfig{
+		Limiter:          ratelimit.NewLimiter(2, 2, time.Hour),
+		DryRun:           true,
+		DryRunRejections: &rejections,
+		OnDryRunReject: func(r *http.Request, key string) {
+			rejected = append(rejected, key)
+		},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Request %d: expected 200 in dry run, got %d", i, rec.Code)
+		}
+		if rec.Header().Get("X-RateLimit-Limit") != "" || rec.Header().Get("Retry-After") != "" {
+			t.Errorf("Request %d: expected no rate limit headers in dry run", i)
+		}
+	}
+
+	if served != 5 {
+		t.Errorf("Expected every request served, got %d", served)
+	}
+	if got := rejections.Load(); got != 3 {
+		t.Errorf("Expected 3 would-be rejections counted, got %d", got)
+	}
+	if len(rejected) != 3 || rejected[0] != "192.0.2.1" {
+		t.Errorf("Expected the callback for each would-be rejection, got %v", rejected)
+	}
+}
+
+func TestRateLimitMaxWait(t *testing.T) {
+	for _, name := range []string{"limiter", "composite"} {
+		t.Run(name, func(t *testing.T) {
+			clock := ratelimittest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			// One request per 100ms
+			var limiter ratelimit.RateLimiter = ratelimit.NewLimiter(1, 10, time.Second,
+				ratelimit.WithRefillMode(ratelimit.RefillContinuous), ratelimit.WithClock(clock))
+			if name == "composite" {
+				limiter = ratelimit.NewComposite(ratelimit.Level{Name: "client", Limiter: limiter})
+			}
+
+			handler := RateLimit(RateLimitConfig{
+				Limiter: limiter,
+				MaxWait: time.Second,
+				Clock:   clock,
+			})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+			served := make(chan int, 1)
+			go func() {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				served <- rec.Code
+			}()
+
+			// The request is held with its timeout and its retry pending
+			clock.BlockUntil(2)
+			select {
+			case code := <-served:
+				t.Fatalf("Expected the request to be held for capacity, got %d", code)
+			default:
+			}
+
+			clock.Advance(100 * time.Millisecond)
+			if code := <-served; code != http.StatusOK {
+				t.Errorf("Expected to be served after waiting, got %d", code)
+			}
+		})
+	}
+}
+
+func TestRateLimitMaxWaitTooShort(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := RateLimit(RateLimitConfig{
+		Limiter: ratelimit.NewLimiter(1, 1, time.Hour, ratelimit.WithClock(clock)),
+		MaxWait: time.Second,
+		Clock:   clock,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// The next token is an hour away, so the request is rejected without
+	// waiting for the clock to move
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Expected Retry-After of an hour, got %s", got)
+	}
+}
+
+func TestRateLimitMaxWaitQuotaExhausted(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	quota := ratelimit.NewQuota(1, ratelimit.QuotaDaily, ratelimit.WithClock(clock))
+	burst := ratelimit.NewLimiter(10, 10, time.Second, ratelimit.WithClock(clock))
+
+	handler := RateLimit(RateLimitConfig{
+		Limiter: ratelimit.NewComposite(
+			ratelimit.Level{Name: "burst", Limiter: burst},
+			ratelimit.Level{Name: "quota", Limiter: quota},
+		),
+		Quota:   quota,
+		MaxWait: time.Second,
+		Clock:   clock,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// The quota resets at midnight, so the request isn't held at all
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", rec.Code)
+	}
+	if waiters := clock.Waiters(); waiters != 0 {
+		t.Errorf("Expected no wait, got %d pending", waiters)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "43200" {
+		t.Errorf("Expected Retry-After until midnight, got %s", got)
+	}
+	if info, _ := burst.Inspect("192.0.2.1"); info.Remaining != 9 {
+		t.Errorf("Expected the burst level to be refunded, got %d remaining", info.Remaining)
+	}
+}
+
+func TestRateLimitMaxQueue(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// One request per 200ms
+	handler := RateLimit(RateLimitConfig{
+		Limiter: ratelimit.NewLimiter(1, 5, time.Second,
+			ratelimit.WithRefillMode(ratelimit.RefillContinuous), ratelimit.WithClock(clock)),
+		MaxWait:  time.Second,
+		MaxQueue: 1,
+		Clock:    clock,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	queued := make(chan int, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		queued <- rec.Code
+	}()
+	clock.BlockUntil(2)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 with the queue full, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After on the rejection")
+	}
+
+	clock.Advance(200 * time.Millisecond)
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("Expected the queued request to be served, got %d", code)
+	}
+}
@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AIMDConfig configures an AdaptiveLimiter
+type AIMDConfig struct {
+	// MinRate and MaxRate bound the allowed requests per Interval.
+	// The limiter starts at MaxRate.
+	MinRate int64
+	MaxRate int64
+
+	// Interval is the period the rate is measured over (defaults to 1 second)
+	Interval time.Duration
+
+	// Increase is added to the rate after each healthy window (defaults to
+	// 5% of MaxRate, at least 1)
+	Increase int64
+
+	// Decrease multiplies the rate after an unhealthy window (defaults to 0.5)
+	Decrease float64
+
+	// ErrorThreshold is the share of failed responses in a window that makes
+	// it unhealthy (defaults to 0.1)
+	ErrorThreshold float64
+
+	// LatencyThreshold is the mean response latency above which a window is
+	// unhealthy (0 ignores latency)
+	LatencyThreshold time.Duration
+
+	// Window is how often the rate is adjusted (defaults to 1 second)
+	Window time.Duration
+
+	// MinSamples is the number of responses a window needs before it can be
+	// judged unhealthy, so one early failure doesn't halve the rate
+	// (defaults to 10)
+	MinSamples int64
+}
+
+// withDefaults fills zero fields
+func (c AIMDConfig) withDefaults() AIMDConfig {
+	if c.MinRate <= 0 {
+		c.MinRate = 1
+	}
+	if c.MaxRate < c.MinRate {
+		c.MaxRate = c.MinRate
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	if c.Increase <= 0 {
+		c.Increase = max(c.MaxRate/20, 1)
+	}
+	if c.Decrease <= 0 || c.Decrease >= 1 {
+		c.Decrease = 0.5
+	}
+	if c.ErrorThreshold <= 0 {
+		c.ErrorThreshold = 0.1
+	}
+	if c.Window <= 0 {
+		c.Window = time.Second
+	}
+	if c.MinSamples <= 0 {
+		c.MinSamples = 10
+	}
+	return c
+}
+
+// AdaptiveLimiter is a rate limiter whose rate follows the health of the
+// backend it protects, using additive increase/multiplicative decrease
+// (AIMD): after each window with too many failures or too much latency the
+// rate is cut by a factor, and after each healthy window with traffic it
+// grows by a fixed step, staying between MinRate and MaxRate. Report each
+// response with Observe.
+// Safe for concurrent use by multiple goroutines
+type AdaptiveLimiter struct {
+	config  AIMDConfig
+	limiter *Limiter
+	rate    int64
+	clock   Clock
+
+	windowStart time.Time
+	requests    int64
+	failures    int64
+	latency     time.Duration // Total over the window
+	decreases   uint64
+	increases   uint64
+	mu          sync.Mutex
+}
+
+// NewAdaptiveLimiter creates a limiter starting at config.MaxRate.
+// Options configure the underlying Limiter, such as WithClock.
+func NewAdaptiveLimiter(config AIMDConfig, opts ...Option) *AdaptiveLimiter {
+	config = config.withDefaults()
+	o := newOptions(opts)
+
+	return &AdaptiveLimiter{
+		config:      config,
+		limiter:     NewLimiter(config.MaxRate, config.MaxRate, config.Interval, opts...),
+		rate:        config.MaxRate,
+		clock:       o.clock,
+		windowStart: o.clock.Now(),
+	}
+}
+
+// Allow checks if a request for the given key is allowed at the current rate
+func (a *AdaptiveLimiter) Allow(key string) bool {
+	return a.limiter.Allow(key)
+}
+
+// AllowN checks if n requests for the given key are allowed at the current rate
+func (a *AdaptiveLimiter) AllowN(key string, n int64) bool {
+	return a.limiter.AllowN(key, n)
+}
+
+// WaitN blocks until n requests for the given key are allowed at the
+// current rate; see Limiter.WaitN
+func (a *AdaptiveLimiter) WaitN(ctx context.Context, key string, n int64) error {
+	return a.limiter.WaitN(ctx, key, n)
+}
+
+// Refund gives back n requests for the given key
+func (a *AdaptiveLimiter) Refund(key string, n int64) {
+	a.limiter.Refund(key, n)
+}
+
+// Reset clears the rate limit state for the given key
+func (a *AdaptiveLimiter) Reset(key string) {
+	a.limiter.Reset(key)
+}
+
+// Inspect returns the state of the given key at the current rate
+func (a *AdaptiveLimiter) Inspect(key string) (KeyInfo, bool) {
+	return a.limiter.Inspect(key)
+}
+
+// Observe reports the outcome of a request that was let through: how long
+// the backend took and whether it failed (such as a 5xx or a connection
+// error). Once a window has passed, the rate is adjusted.
+func (a *AdaptiveLimiter) Observe(latency time.Duration, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.requests++
+	a.latency += latency
+	if failed {
+		a.failures++
+	}
+
+	if now := a.clock.Now(); now.Sub(a.windowStart) >= a.config.Window {
+		a.adjust()
+		a.windowStart = now
+		a.requests, a.failures, a.latency = 0, 0, 0
+	}
+}
+
+// adjust applies AIMD to the rate based on the window that just ended
+// Must be called with lock held
+func (a *AdaptiveLimiter) adjust() {
+	rate := a.rate
+	if a.unhealthy() {
+		rate = max(int64(float64(rate)*a.config.Decrease), a.config.MinRate)
+		a.decreases++
+	} else {
+		rate = min(rate+a.config.Increase, a.config.MaxRate)
+		a.increases++
+	}
+
+	if rate != a.rate {
+		a.rate = rate
+		a.limiter.Update(rate, rate, a.config.Interval)
+	}
+}
+
+// unhealthy reports whether the window saw too many failures or too much latency
+// Must be called with lock held
+func (a *AdaptiveLimiter) unhealthy() bool {
+	if a.requests < a.config.MinSamples {
+		return false
+	}
+	if float64(a.failures)/float64(a.requests) > a.config.ErrorThreshold {
+		return true
+	}
+	return a.config.LatencyThreshold > 0 && a.latency/time.Duration(a.requests) > a.config.LatencyThreshold
+}
+
+// Rate returns the current allowed requests per interval
+func (a *AdaptiveLimiter) Rate() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.rate
+}
+
+// Stop stops the underlying Limiter's background work, if any
+func (a *AdaptiveLimiter) Stop() {
+	a.limiter.Stop()
+}
+
+// Stats returns statistics about the limiter, including the current rate
+// and how often it has been adjusted
+func (a *AdaptiveLimiter) Stats() map[string]interface{} {
+	stats := a.limiter.Stats()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats["rate"] = a.rate
+	stats["min_rate"] = a.config.MinRate
+	stats["max_rate"] = a.config.MaxRate
+	stats["decreases"] = a.decreases
+	stats["increases"] = a.increases
+	return stats
+}
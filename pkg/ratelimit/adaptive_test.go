@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// observeWindow reports a window of responses and moves past its end
+func observeWindow(a *AdaptiveLimiter, clock interface{ Advance(time.Duration) }, requests, failures int, latency time.Duration) {
+	for i := 0; i < requests; i++ {
+		if i == requests-1 {
+			clock.Advance(time.Second)
+		}
+		a.Observe(latency, i < failures)
+	}
+}
+
+func TestAdaptiveLimiterAIMD(t *testing.T) {
+	clock := newTestClock()
+	a := NewAdaptiveLimiter(AIMDConfig{MinRate: 10, MaxRate: 100, Increase: 10}, WithClock(clock))
+
+	if a.Rate() != 100 {
+		t.Fatalf("Expected to start at the max rate, got %d", a.Rate())
+	}
+
+	// Failing backends halve the rate each window, down to the minimum
+	for _, want := range []int64{50, 25, 12, 10, 10} {
+		observeWindow(a, clock, 20, 10, time.Millisecond)
+		if a.Rate() != want {
+			t.Fatalf("Expected rate %d after a failing window, got %d", want, a.Rate())
+		}
+	}
+
+	// Recovery grows the rate by a fixed step
+	for _, want := range []int64{20, 30, 40} {
+		observeWindow(a, clock, 20, 0, time.Millisecond)
+		if a.Rate() != want {
+			t.Fatalf("Expected rate %d after a healthy window, got %d", want, a.Rate())
+		}
+	}
+}
+
+func TestAdaptiveLimiterEnforcesRate(t *testing.T) {
+	clock := newTestClock()
+	a := NewAdaptiveLimiter(AIMDConfig{MinRate: 2, MaxRate: 8}, WithClock(clock))
+
+	observeWindow(a, clock, 10, 10, time.Millisecond)
+	if a.Rate() != 4 {
+		t.Fatalf("Expected the rate to halve to 4, got %d", a.Rate())
+	}
+
+	// The limiter refilled during the window, and its full bucket now holds 4
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if a.Allow("route") {
+			allowed++
+		}
+	}
+	if allowed != 4 {
+		t.Errorf("Expected 4 requests at the reduced rate, got %d", allowed)
+	}
+}
+
+func TestAdaptiveLimiterLatency(t *testing.T) {
+	clock := newTestClock()
+	a := NewAdaptiveLimiter(AIMDConfig{MinRate: 1, MaxRate: 100, LatencyThreshold: 100 * time.Millisecond}, WithClock(clock))
+
+	observeWindow(a, clock, 20, 0, 50*time.Millisecond)
+	if a.Rate() != 100 {
+		t.Errorf("Expected fast responses to keep the rate, got %d", a.Rate())
+	}
+
+	observeWindow(a, clock, 20, 0, 300*time.Millisecond)
+	if a.Rate() != 50 {
+		t.Errorf("Expected slow responses to halve the rate, got %d", a.Rate())
+	}
+}
+
+func TestAdaptiveLimiterNeedsSamples(t *testing.T) {
+	clock := newTestClock()
+	a := NewAdaptiveLimiter(AIMDConfig{MinRate: 1, MaxRate: 100}, WithClock(clock))
+
+	// A single failure in a quiet window isn't enough to cut the rate
+	observeWindow(a, clock, 1, 1, time.Millisecond)
+	if a.Rate() != 100 {
+		t.Errorf("Expected the rate to hold with too few samples, got %d", a.Rate())
+	}
+	if stats := a.Stats(); stats["decreases"] != uint64(0) || stats["rate"] != int64(100) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
@@ -0,0 +1,218 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// atomicParams are an AtomicTokenBucket's limits, swapped as one value on
+// reconfiguration
+type atomicParams struct {
+	capacity int64
+	emission int64 // Nanoseconds to earn one token
+	refills  bool  // Whether tokens are earned back; false if the refill rate is 0
+}
+
+// newAtomicParams returns the params of a bucket with the given limits
+func newAtomicParams(capacity, refillRate int64, interval time.Duration) *atomicParams {
+	emission, refills := emissionFor(refillRate, interval)
+	return &atomicParams{capacity: capacity, emission: int64(emission), refills: refills}
+}
+
+// tolerance is how far ahead of now the full time may run
+func (p *atomicParams) tolerance() int64 {
+	return p.capacity * p.emission
+}
+
+// AtomicTokenBucket is a token bucket that refills continuously and never
+// takes a lock. Its tokens and refill timestamp are packed into one atomic
+// word: the time at which the bucket will be full again, from which the
+// tokens available at any instant follow. Each request is a single
+// compare-and-swap, so parallel callers don't serialise on a mutex.
+// It admits the same requests as a TokenBucket with RefillContinuous,
+// except that the time to earn a token is rounded down to the nanosecond.
+// Safe for concurrent use by multiple goroutines
+type AtomicTokenBucket struct {
+	params atomic.Pointer[atomicParams]
+	full   atomic.Int64 // Nanoseconds after epoch when the bucket is full again
+	epoch  time.Time
+	clock  Clock
+}
+
+// NewAtomicTokenBucket creates a lock-free token bucket
+// capacity: maximum number of tokens
+// refillRate: number of tokens earned per interval, continuously
+// interval: the period refillRate is measured over
+// A refillRate of 0 never earns tokens back, so once the capacity is used
+// every request is rejected.
+func NewAtomicTokenBucket(capacity, refillRate int64, interval time.Duration, opts ...Option) *AtomicTokenBucket {
+	return newAtomicTokenBucket(capacity, refillRate, interval, newOptions(opts))
+}
+
+func newAtomicTokenBucket(capacity, refillRate int64, interval time.Duration, o options) *AtomicTokenBucket {
+	tb := &AtomicTokenBucket{
+		epoch: o.clock.Now(),
+		clock: o.clock,
+	}
+	p := newAtomicParams(capacity, refillRate, interval)
+	tb.params.Store(p)
+	tb.full.Store(tb.now(p))
+	return tb
+}
+
+// now returns the current time in nanoseconds after epoch, or frozenTime
+// if the bucket never refills
+func (tb *AtomicTokenBucket) now(p *atomicParams) int64 {
+	if !p.refills {
+		return int64(frozenTime.Sub(tb.epoch))
+	}
+	return int64(tb.clock.Now().Sub(tb.epoch))
+}
+
+// Allow checks if a request can proceed and consumes a token if available
+func (tb *AtomicTokenBucket) Allow() bool {
+	return tb.AllowN(1)
+}
+
+// AllowN checks if n tokens are available and consumes them if so
+func (tb *AtomicTokenBucket) AllowN(n int64) bool {
+	p := tb.params.Load()
+	now := tb.now(p)
+
+	for {
+		full := tb.full.Load()
+		newFull := max(full, now) + n*p.emission
+		if newFull-now > p.tolerance() {
+			return false
+		}
+		if tb.full.CompareAndSwap(full, newFull) {
+			return true
+		}
+	}
+}
+
+// Available returns the current number of available tokens
+func (tb *AtomicTokenBucket) Available() int64 {
+	p := tb.params.Load()
+	ahead := tb.full.Load() - tb.now(p)
+	if ahead <= 0 {
+		return p.capacity
+	}
+	// Tokens reserved ahead of time are owed before any become available
+	return max((p.tolerance()-ahead)/p.emission, 0)
+}
+
+// Capacity returns the maximum capacity of the bucket
+func (tb *AtomicTokenBucket) Capacity() int64 {
+	return tb.params.Load().capacity
+}
+
+// TimeUntil returns how long until n tokens are available, or 0 if they
+// already are. It returns InfDuration if n exceeds the capacity, or if they
+// never will be because the refill rate is 0.
+func (tb *AtomicTokenBucket) TimeUntil(n int64) time.Duration {
+	p := tb.params.Load()
+	return tb.delayFor(p, tb.full.Load(), n, tb.now(p))
+}
+
+// delayFor returns how long after now n tokens are available, given the full time
+func (tb *AtomicTokenBucket) delayFor(p *atomicParams, full, n, now int64) time.Duration {
+	if n > p.capacity {
+		return InfDuration
+	}
+	delay := max(full, now) + n*p.emission - now - p.tolerance()
+	if delay <= 0 {
+		return 0
+	}
+	if !p.refills {
+		return InfDuration
+	}
+	return time.Duration(delay)
+}
+
+// Reserve reserves one token; see ReserveN
+func (tb *AtomicTokenBucket) Reserve() *Reservation {
+	return tb.ReserveN(1)
+}
+
+// ReserveN takes n tokens now, even if they haven't been earned yet, and
+// returns a reservation saying how long the caller must wait before using
+// them. The reservation is not OK if n exceeds capacity, or if the tokens
+// will never be earned because the refill rate is 0.
+func (tb *AtomicTokenBucket) ReserveN(n int64) *Reservation {
+	p := tb.params.Load()
+	now := tb.now(p)
+
+	for {
+		full := tb.full.Load()
+		delay := tb.delayFor(p, full, n, now)
+		if delay == InfDuration {
+			return &Reservation{}
+		}
+
+		if tb.full.CompareAndSwap(full, max(full, now)+n*p.emission) {
+			return &Reservation{
+				ok:        true,
+				tokens:    n,
+				timeToAct: tb.epoch.Add(time.Duration(now) + delay),
+				clock:     tb.clock,
+				cancel:    func() { tb.refund(n) },
+			}
+		}
+	}
+}
+
+// Wait blocks until a token is available; see WaitN
+func (tb *AtomicTokenBucket) Wait(ctx context.Context) error {
+	return tb.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n tokens are available and consumes them. It returns
+// an error if n exceeds capacity, ctx is cancelled, or the wait would last
+// past ctx's deadline; in those cases no tokens are consumed.
+func (tb *AtomicTokenBucket) WaitN(ctx context.Context, n int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return waitReservation(ctx, tb.ReserveN(n))
+}
+
+// refund gives back n tokens, such as those held by a cancelled reservation
+func (tb *AtomicTokenBucket) refund(n int64) {
+	tb.full.Add(-n * tb.params.Load().emission)
+}
+
+// reconfigure applies new limits, keeping the used tokens or, with rescale,
+// their share of the capacity. Requests racing with it may be judged
+// against the old limits.
+func (tb *AtomicTokenBucket) reconfigure(p Policy, rescale bool) {
+	old := tb.params.Load()
+	params := newAtomicParams(p.Capacity, p.RefillRate, p.Interval)
+	tb.params.Store(params)
+
+	oldNow, now := tb.now(old), tb.now(params)
+	for {
+		full := tb.full.Load()
+
+		// How far ahead the full time runs is the tokens used, in emission intervals
+		newFull := now
+		if ahead := full - oldNow; ahead > 0 {
+			used := carryShare(float64(ahead)/float64(old.emission), old.capacity, params.capacity, rescale)
+			newFull += int64(used * float64(params.emission))
+		}
+		if tb.full.CompareAndSwap(full, newFull) {
+			return
+		}
+	}
+}
+
+// state returns the time the bucket is full again
+func (tb *AtomicTokenBucket) state() bucketState {
+	return bucketState{At: tb.epoch.Add(time.Duration(tb.full.Load()))}
+}
+
+// setState restores the full time saved by state
+func (tb *AtomicTokenBucket) setState(s bucketState) {
+	tb.full.Store(int64(s.At.Sub(tb.epoch)))
+}
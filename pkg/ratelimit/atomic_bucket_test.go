@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAtomicTokenBucketMatchesTokenBucket(t *testing.T) {
+	configs := []struct {
+		capacity, refillRate int64
+		interval             time.Duration
+	}{
+		{10, 10, 100 * time.Millisecond},
+		{5, 1, time.Second},
+		{100, 50, time.Minute},
+	}
+
+	for _, cfg := range configs {
+		clock := newTestClock()
+		mutex := NewTokenBucket(cfg.capacity, cfg.refillRate, cfg.interval, WithRefillMode(RefillContinuous), WithClock(clock))
+		atomicTB := NewAtomicTokenBucket(cfg.capacity, cfg.refillRate, cfg.interval, WithClock(clock))
+		rng := rand.New(rand.NewSource(1))
+
+		for i := 0; i < 10000; i++ {
+			clock.Advance(time.Duration(rng.Int63n(int64(cfg.interval) / cfg.refillRate * 2)))
+
+			n := rng.Int63n(cfg.capacity) + 1
+			if got, want := atomicTB.AllowN(n), mutex.AllowN(n); got != want {
+				t.Fatalf("%+v step %d: AllowN(%d) = %v, token bucket says %v", cfg, i, n, got, want)
+			}
+			if got, want := atomicTB.Available(), mutex.Available(); got != want {
+				t.Fatalf("%+v step %d: Available() = %d, token bucket says %d", cfg, i, got, want)
+			}
+			if got, want := atomicTB.TimeUntil(n), mutex.TimeUntil(n); got != want {
+				t.Fatalf("%+v step %d: TimeUntil(%d) = %v, token bucket says %v", cfg, i, n, got, want)
+			}
+		}
+	}
+}
+
+func TestAtomicTokenBucketConcurrent(t *testing.T) {
+	buckets := map[string]interface{ AllowN(int64) bool }{
+		"atomic": NewAtomicTokenBucket(1000, 1, time.Hour),
+		"mutex":  NewTokenBucket(1000, 1, time.Hour, WithRefillMode(RefillContinuous)),
+	}
+
+	for name, tb := range buckets {
+		t.Run(name, func(t *testing.T) {
+			var allowed atomic.Int64
+			var wg sync.WaitGroup
+			for g := 0; g < 50; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 100; i++ {
+						if tb.AllowN(1) {
+							allowed.Add(1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			// No token may be handed out twice or lost under contention
+			if allowed.Load() != 1000 {
+				t.Errorf("Expected exactly 1000 requests allowed, got %d", allowed.Load())
+			}
+		})
+	}
+}
+
+func TestAtomicTokenBucketReserve(t *testing.T) {
+	clock := newTestClock()
+	tb := NewAtomicTokenBucket(2, 2, time.Second, WithClock(clock))
+	tb.AllowN(2)
+
+	r := tb.Reserve()
+	if !r.OK() || r.Delay() != 500*time.Millisecond {
+		t.Fatalf("Expected a 500ms reservation, got ok=%v delay=%v", r.OK(), r.Delay())
+	}
+
+	r.Cancel()
+	clock.Advance(500 * time.Millisecond)
+	if !tb.Allow() {
+		t.Error("Expected the cancelled reservation's token to be available")
+	}
+
+	if tb.ReserveN(tb.Capacity() + 1).OK() {
+		t.Error("Expected reserving beyond capacity to fail")
+	}
+}
+
+func TestAtomicTokenBucketZeroRefill(t *testing.T) {
+	clock := newTestClock()
+	tb := NewAtomicTokenBucket(3, 0, time.Minute, WithClock(clock))
+
+	if !tb.AllowN(2) || tb.Available() != 1 {
+		t.Fatalf("Expected 1 token left, got %d", tb.Available())
+	}
+	if wait := tb.TimeUntil(2); wait != InfDuration {
+		t.Errorf("Expected to wait forever, got %v", wait)
+	}
+	if tb.ReserveN(2).OK() {
+		t.Error("Expected a reservation that can never be met to fail")
+	}
+
+	clock.Advance(24 * time.Hour)
+	if !tb.Allow() || tb.Allow() {
+		t.Error("Expected only the remaining token, with none earned back")
+	}
+
+	tb.reconfigure(Policy{Capacity: 3, RefillRate: 3, Interval: time.Minute}, true)
+	clock.Advance(20 * time.Second)
+	if !tb.Allow() || tb.Allow() {
+		t.Error("Expected one token earned back once a refill rate is set")
+	}
+}
+
+func BenchmarkAtomicTokenBucketAllow(b *testing.B) {
+	tb := NewAtomicTokenBucket(int64(b.N), int64(b.N), time.Minute)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tb.Allow()
+	}
+}
+
+func BenchmarkAtomicTokenBucketAllowConcurrent(b *testing.B) {
+	tb := NewAtomicTokenBucket(int64(b.N), int64(b.N), time.Minute)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.Allow()
+		}
+	})
+}
+
+func BenchmarkLimiterConcurrentHotKey(b *testing.B) {
+	for _, algorithm := range []Algorithm{TokenBucketAlgorithm, AtomicTokenBucketAlgorithm} {
+		b.Run(algorithm.String(), func(b *testing.B) {
+			limiter := NewLimiter(int64(b.N), int64(b.N), time.Minute, WithAlgorithm(algorithm))
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					limiter.Allow("hot-key")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+)
+
+// Waiter is implemented by limiters that can block until n tokens are
+// available. TokenBucket, AtomicTokenBucket and GCRA implement it, and
+// Limiter.Waiter binds a Limiter to one key.
+type Waiter interface {
+	// WaitN blocks until n tokens are available and consumes them
+	WaitN(ctx context.Context, n int64) error
+
+	// Capacity returns the most tokens WaitN can ever be asked for
+	Capacity() int64
+}
+
+// keyWaiter is a Waiter spending one key's tokens on a Limiter
+type keyWaiter struct {
+	limiter *Limiter
+	key     string
+}
+
+// WaitN blocks until n tokens are available for the key
+func (kw keyWaiter) WaitN(ctx context.Context, n int64) error {
+	return kw.limiter.WaitN(ctx, kw.key, n)
+}
+
+// Capacity returns the key's capacity
+func (kw keyWaiter) Capacity() int64 {
+	return kw.limiter.Policy(kw.key).Capacity
+}
+
+// Waiter returns a Waiter that spends the given key's tokens, so a
+// per-client Limiter can throttle each client's bandwidth with NewReader
+// and NewWriter
+func (l *Limiter) Waiter(key string) Waiter {
+	return keyWaiter{limiter: l, key: key}
+}
+
+// Reader throttles reads from an io.Reader to a byte rate, spending one
+// token per byte read
+type Reader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter Waiter
+}
+
+// NewReader returns a reader that reads from r no faster than limiter
+// allows, such as NewTokenBucket(64<<10, 64<<10, time.Second) for 64 KiB/s
+// with a 64 KiB burst. Reads block until the bytes they returned are paid
+// for, and fail with ctx's error once ctx is done.
+func NewReader(ctx context.Context, r io.Reader, limiter Waiter) *Reader {
+	return &Reader{ctx: ctx, r: r, limiter: limiter}
+}
+
+// Read reads at most the limiter's capacity, then waits for a token per
+// byte read. If the wait fails, the bytes read are returned with its error.
+// It fails with ErrExceedsCapacity if the limiter has no capacity, since
+// no byte could ever be paid for.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	capacity := r.limiter.Capacity()
+	if capacity <= 0 {
+		return 0, ErrExceedsCapacity
+	}
+	if int64(len(p)) > capacity {
+		p = p[:capacity]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, int64(n)); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Writer throttles writes to an io.Writer to a byte rate, spending one
+// token per byte written
+type Writer struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter Waiter
+}
+
+// NewWriter returns a writer that writes to w no faster than limiter
+// allows. Writes are split into chunks of at most the limiter's capacity,
+// each written once its tokens are available, and fail with ctx's error
+// once ctx is done.
+func NewWriter(ctx context.Context, w io.Writer, limiter Waiter) *Writer {
+	return &Writer{ctx: ctx, w: w, limiter: limiter}
+}
+
+// Write writes p in chunks as tokens become available, returning the
+// number of bytes written before any error. It fails with
+// ErrExceedsCapacity if the limiter has no capacity.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		capacity := w.limiter.Capacity()
+		if capacity <= 0 {
+			return written, ErrExceedsCapacity
+		}
+
+		chunk := p
+		if int64(len(chunk)) > capacity {
+			chunk = chunk[:capacity]
+		}
+
+		if err := w.limiter.WaitN(w.ctx, int64(len(chunk))); err != nil {
+			return written, err
+		}
+
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
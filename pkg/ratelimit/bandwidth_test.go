@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaderThrottles(t *testing.T) {
+	clock := newTestClock()
+	// 10 bytes per second, 10 byte burst
+	tb := NewTokenBucket(10, 10, time.Second, WithRefillMode(RefillContinuous), WithClock(clock))
+	payload := strings.Repeat("x", 35)
+
+	done := make(chan []byte, 1)
+	start := clock.Now()
+	go func() {
+		data, _ := io.ReadAll(NewReader(context.Background(), strings.NewReader(payload), tb))
+		done <- data
+	}()
+
+	for {
+		select {
+		case data := <-done:
+			if string(data) != payload {
+				t.Fatalf("Expected the payload to be read intact, got %d bytes", len(data))
+			}
+			// The burst is free; the other 25 bytes take 2.5s
+			if elapsed := clock.Now().Sub(start); elapsed != 2500*time.Millisecond {
+				t.Errorf("Expected the read to take 2.5s, took %v", elapsed)
+			}
+			return
+		default:
+		}
+
+		if clock.Waiters() > 0 {
+			clock.Advance(100 * time.Millisecond)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReaderContextCancelled(t *testing.T) {
+	clock := newTestClock()
+	tb := NewTokenBucket(4, 4, time.Second, WithClock(clock))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := NewReader(ctx, strings.NewReader("0123456789"), tb)
+	buf := make([]byte, 10)
+	if n, err := r.Read(buf); n != 4 || err != nil {
+		t.Fatalf("Expected a first read of the 4 byte burst, got %d, %v", n, err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.Read(buf)
+		errs <- err
+	}()
+
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWriterChunksByCapacity(t *testing.T) {
+	clock := newTestClock()
+	tb := NewTokenBucket(4, 4, time.Second, WithClock(clock))
+
+	var out bytes.Buffer
+	w := NewWriter(context.Background(), &out, tb)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("0123456789"))
+		done <- err
+	}()
+
+	// 4 bytes go out at once, then 4 more after each refill
+	for _, want := range []string{"0123", "01234567"} {
+		clock.BlockUntil(1)
+		if out.String() != want {
+			t.Fatalf("Expected %q written so far, got %q", want, out.String())
+		}
+		clock.Advance(time.Second)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if out.String() != "0123456789" {
+		t.Errorf("Expected everything written, got %q", out.String())
+	}
+}
+
+func TestLimiterWaiterPerKey(t *testing.T) {
+	limiter := NewLimiter(8, 8, time.Hour)
+
+	write := func(key string) int {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		n, err := NewWriter(ctx, io.Discard, limiter.Waiter(key)).Write([]byte("0123456789"))
+		if !errors.Is(err, ErrWouldExceedDeadline) {
+			t.Errorf("Expected ErrWouldExceedDeadline once %s's allowance ran out, got %v", key, err)
+		}
+		return n
+	}
+
+	// Each client has its own 8 byte allowance
+	if n := write("a"); n != 8 {
+		t.Errorf("Expected 8 bytes before a's allowance ran out, got %d", n)
+	}
+	if n := write("b"); n != 8 {
+		t.Errorf("Expected b to have its own allowance, got %d", n)
+	}
+}
+
+func TestReaderWriterZeroCapacity(t *testing.T) {
+	limiter := NewTokenBucket(0, 0, time.Second)
+
+	r := NewReader(context.Background(), strings.NewReader("data"), limiter)
+	if n, err := r.Read(make([]byte, 4)); n != 0 || !errors.Is(err, ErrExceedsCapacity) {
+		t.Errorf("Expected ErrExceedsCapacity from Read, got %d, %v", n, err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(context.Background(), &buf, limiter)
+	if n, err := w.Write([]byte("data")); n != 0 || !errors.Is(err, ErrExceedsCapacity) {
+		t.Errorf("Expected ErrExceedsCapacity from Write, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,25 @@
+package ratelimit
+
+import "time"
+
+// Clock tells the time and schedules wakeups for the limiters in this package.
+// The default uses the time package; tests can substitute a fake such as
+// ratelimittest.Clock to control time exactly.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// After returns a channel that receives the time once d has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import "sync/atomic"
+
+// Refunder is implemented by rate limiters that can give back requests
+// taken by AllowN, so a Composite can undo a partial admission
+type Refunder interface {
+	Refund(key string, n int64)
+}
+
+// Level is one tier of a Composite limit
+type Level struct {
+	// Name identifies the level in stats (e.g., "global", "route", "client")
+	Name string
+
+	// Limiter enforces this level's limit
+	Limiter RateLimiter
+
+	// Key maps the request key to the key charged at this level.
+	// Nil charges the request key itself; use StaticKey for a shared limit.
+	Key func(key string) string
+}
+
+// key returns the key charged at this level for a request key
+func (lv Level) key(key string) string {
+	if lv.Key == nil {
+		return key
+	}
+	return lv.Key(key)
+}
+
+// StaticKey returns a Level key function that charges every request to the
+// same key, turning a per-key limiter into a shared limit
+func StaticKey(shared string) func(string) string {
+	return func(string) string {
+		return shared
+	}
+}
+
+// Composite admits a request only if every level has capacity, such as a
+// gateway-wide limit, a per-route limit and a per-client limit together.
+// Levels are charged in order; if one rejects, the levels already charged
+// are refunded so a rejected request doesn't use up anyone's allowance.
+// Concurrent requests may briefly see capacity held by a request that is
+// about to be refunded.
+// Safe for concurrent use by multiple goroutines
+type Composite struct {
+	levels   []Level
+	rejected []atomic.Uint64 // Rejections per level
+}
+
+// NewComposite creates a limiter that enforces every level. Levels whose
+// limiter doesn't implement Refunder can't be rolled back, so put them last.
+func NewComposite(levels ...Level) *Composite {
+	return &Composite{
+		levels:   levels,
+		rejected: make([]atomic.Uint64, len(levels)),
+	}
+}
+
+// Allow checks if a request for the given key is allowed at every level
+func (c *Composite) Allow(key string) bool {
+	return c.AllowN(key, 1)
+}
+
+// AllowN checks if n requests for the given key are allowed at every level
+func (c *Composite) AllowN(key string, n int64) bool {
+	for i, level := range c.levels {
+		if level.Limiter.AllowN(level.key(key), n) {
+			continue
+		}
+
+		c.rejected[i].Add(1)
+		c.refundLevels(key, n, i)
+		return false
+	}
+	return true
+}
+
+// Refund gives back n requests for the given key at every level
+func (c *Composite) Refund(key string, n int64) {
+	c.refundLevels(key, n, len(c.levels))
+}
+
+// refundLevels gives back n requests at the first count levels
+func (c *Composite) refundLevels(key string, n int64, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if r, ok := c.levels[i].Limiter.(Refunder); ok {
+			r.Refund(c.levels[i].key(key), n)
+		}
+	}
+}
+
+// Inspect returns the state of the key at the most restrictive level that
+// tracks it: the one with the fewest requests remaining, or of those, the
+// one that takes longest to let the next request through. Levels whose
+// limiter doesn't implement Inspector are skipped.
+func (c *Composite) Inspect(key string) (KeyInfo, bool) {
+	var (
+		tightest KeyInfo
+		found    bool
+	)
+	for _, level := range c.levels {
+		in, ok := level.Limiter.(Inspector)
+		if !ok {
+			continue
+		}
+		info, ok := in.Inspect(level.key(key))
+		if !ok {
+			continue
+		}
+
+		if !found || info.Remaining < tightest.Remaining ||
+			(info.Remaining == tightest.Remaining && info.NextRefill.After(tightest.NextRefill)) {
+			tightest = info
+			found = true
+		}
+	}
+
+	if !found {
+		return KeyInfo{}, false
+	}
+	tightest.Key = key
+	return tightest, true
+}
+
+// Reset clears the key's state at the levels that charge the request key
+// itself. Shared levels are left alone, since resetting one client
+// shouldn't reset everyone's limit.
+func (c *Composite) Reset(key string) {
+	for _, level := range c.levels {
+		if level.Key == nil {
+			level.Limiter.Reset(key)
+		}
+	}
+}
+
+// Stats returns statistics for each level, including how many requests it rejected
+func (c *Composite) Stats() map[string]interface{} {
+	levels := make([]map[string]interface{}, len(c.levels))
+	for i, level := range c.levels {
+		levels[i] = map[string]interface{}{
+			"name":     level.Name,
+			"rejected": c.rejected[i].Load(),
+			"limiter":  level.Limiter.Stats(),
+		}
+	}
+
+	return map[string]interface{}{
+		"levels": levels,
+	}
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompositeAllowsOnlyWhenEveryLevelHasCapacity(t *testing.T) {
+	clock := newTestClock()
+	global := NewLimiter(3, 3, time.Second, WithClock(clock))
+	client := NewLimiter(2, 2, time.Second, WithClock(clock))
+
+	c := NewComposite(
+		Level{Name: "global", Limiter: global, Key: StaticKey("global")},
+		Level{Name: "client", Limiter: client},
+	)
+
+	if !c.Allow("a") || !c.Allow("a") {
+		t.Fatal("Expected the first two requests for a to be allowed")
+	}
+	if c.Allow("a") {
+		t.Error("Expected the client level to reject a's third request")
+	}
+	if !c.Allow("b") {
+		t.Error("Expected b to be allowed by the remaining global capacity")
+	}
+	if c.Allow("c") {
+		t.Error("Expected the global level to reject once it is spent")
+	}
+}
+
+func TestCompositeRefundsEarlierLevelsOnRejection(t *testing.T) {
+	algorithms := []Algorithm{
+		TokenBucketAlgorithm,
+		SlidingWindowLogAlgorithm,
+		SlidingWindowCounterAlgorithm,
+		GCRAAlgorithm,
+		AtomicTokenBucketAlgorithm,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			clock := newTestClock()
+			route := NewLimiter(5, 5, time.Second, WithClock(clock), WithAlgorithm(algorithm))
+			client := NewLimiter(1, 1, time.Second, WithClock(clock), WithAlgorithm(algorithm))
+
+			c := NewComposite(
+				Level{Name: "route", Limiter: route, Key: StaticKey("/api/search")},
+				Level{Name: "client", Limiter: client},
+			)
+
+			c.Allow("greedy")
+			for i := 0; i < 10; i++ {
+				if c.Allow("greedy") {
+					t.Fatal("Expected the client level to reject")
+				}
+			}
+
+			// The rejected requests must not have used up the route's capacity
+			for i := 0; i < 4; i++ {
+				if !c.Allow(string(rune('a' + i))) {
+					t.Fatalf("Expected request %d from another client to be allowed", i)
+				}
+			}
+
+			levels := c.Stats()["levels"].([]map[string]interface{})
+			if rejected := levels[1]["rejected"]; rejected != uint64(10) {
+				t.Errorf("Expected 10 rejections at the client level, got %v", rejected)
+			}
+		})
+	}
+}
+
+func TestCompositeResetLeavesSharedLevels(t *testing.T) {
+	clock := newTestClock()
+	global := NewLimiter(2, 2, time.Second, WithClock(clock))
+	client := NewLimiter(1, 1, time.Second, WithClock(clock))
+
+	c := NewComposite(
+		Level{Name: "global", Limiter: global, Key: StaticKey("global")},
+		Level{Name: "client", Limiter: client},
+	)
+
+	c.Allow("a")
+	c.Reset("a")
+
+	if !c.Allow("a") {
+		t.Error("Expected the client level to be reset")
+	}
+	if c.Allow("b") {
+		t.Error("Expected the global level to keep its usage across a client reset")
+	}
+}
+
+func TestCompositeInspectReportsTightestLevel(t *testing.T) {
+	clock := newTestClock()
+	global := NewLimiter(3, 3, time.Second, WithClock(clock))
+	client := NewLimiter(5, 5, time.Second, WithClock(clock))
+
+	c := NewComposite(
+		Level{Name: "global", Limiter: global, Key: StaticKey("global")},
+		Level{Name: "client", Limiter: client},
+	)
+
+	if _, ok := c.Inspect("a"); ok {
+		t.Error("Expected no state before any request")
+	}
+
+	c.Allow("a")
+	c.Allow("b")
+
+	info, ok := c.Inspect("a")
+	if !ok {
+		t.Fatal("Expected a to be tracked")
+	}
+	if info.Key != "a" {
+		t.Errorf("Expected key a, got %s", info.Key)
+	}
+	if info.Capacity != 3 || info.Remaining != 1 {
+		t.Errorf("Expected the global level's 1 of 3 remaining, got %d of %d", info.Remaining, info.Capacity)
+	}
+}
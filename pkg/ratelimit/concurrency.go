@@ -0,0 +1,156 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrQueueTimeout is returned when a slot doesn't free up within the queue timeout
+var ErrQueueTimeout = errors.New("ratelimit: timed out waiting for a concurrency slot")
+
+// ConcurrencyLimiter caps how many requests per key are in flight at once.
+// Unlike a rate limiter it doesn't care how fast requests arrive, only how
+// many are running, which protects slow endpoints from piling up work.
+// Safe for concurrent use by multiple goroutines
+type ConcurrencyLimiter struct {
+	limit        int64
+	queueTimeout time.Duration
+	slots        map[string]*slot
+	clock        Clock
+	mu           sync.Mutex
+}
+
+// slot is the semaphore for one key. It is removed once no request holds
+// or waits for it.
+type slot struct {
+	sem   chan struct{}
+	users int64 // Requests holding or waiting for the semaphore
+}
+
+// NewConcurrencyLimiter creates a limiter allowing limit in-flight requests per key
+// queueTimeout: how long Acquire waits for a free slot; 0 means don't wait
+func NewConcurrencyLimiter(limit int64, queueTimeout time.Duration, opts ...Option) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		limit:        limit,
+		queueTimeout: queueTimeout,
+		slots:        make(map[string]*slot),
+		clock:        newOptions(opts).clock,
+	}
+}
+
+// TryAcquire takes a slot for key if one is free, without waiting
+func (cl *ConcurrencyLimiter) TryAcquire(key string) bool {
+	s := cl.join(key)
+
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+		cl.leave(key, s)
+		return false
+	}
+}
+
+// Acquire takes a slot for key, waiting up to the queue timeout for one to
+// free up. It returns ErrQueueTimeout if none does, or ctx's error if ctx
+// is done first. Every successful Acquire must be paired with Release.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, key string) error {
+	s := cl.join(key)
+
+	// Fast path: a slot is free
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if cl.queueTimeout <= 0 {
+		cl.leave(key, s)
+		return ErrQueueTimeout
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	case <-cl.clock.After(cl.queueTimeout):
+		cl.leave(key, s)
+		return ErrQueueTimeout
+	case <-ctx.Done():
+		cl.leave(key, s)
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by TryAcquire or Acquire
+func (cl *ConcurrencyLimiter) Release(key string) {
+	cl.mu.Lock()
+	s, exists := cl.slots[key]
+	cl.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	select {
+	case <-s.sem:
+		cl.leave(key, s)
+	default:
+		// Release without a matching acquire
+	}
+}
+
+// join registers interest in key's slot, creating it if needed
+func (cl *ConcurrencyLimiter) join(key string) *slot {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	s, exists := cl.slots[key]
+	if !exists {
+		s = &slot{sem: make(chan struct{}, cl.limit)}
+		cl.slots[key] = s
+	}
+	s.users++
+	return s
+}
+
+// leave drops interest in key's slot, removing it once unused
+func (cl *ConcurrencyLimiter) leave(key string, s *slot) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	s.users--
+	if s.users == 0 && cl.slots[key] == s {
+		delete(cl.slots, key)
+	}
+}
+
+// InFlight returns the number of requests currently holding a slot for key
+func (cl *ConcurrencyLimiter) InFlight(key string) int64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if s, exists := cl.slots[key]; exists {
+		return int64(len(s.sem))
+	}
+	return 0
+}
+
+// Stats returns statistics about the limiter
+func (cl *ConcurrencyLimiter) Stats() map[string]interface{} {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	var inFlight int64
+	for _, s := range cl.slots {
+		inFlight += int64(len(s.sem))
+	}
+
+	return map[string]interface{}{
+		"active_keys":      len(cl.slots),
+		"in_flight":        inFlight,
+		"limit":            cl.limit,
+		"queue_timeout_ms": cl.queueTimeout.Milliseconds(),
+	}
+}
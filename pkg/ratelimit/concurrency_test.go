@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterTryAcquire(t *testing.T) {
+	cl := NewConcurrencyLimiter(2, 0)
+
+	if !cl.TryAcquire("key") || !cl.TryAcquire("key") {
+		t.Fatal("Expected two slots to be free")
+	}
+	if cl.TryAcquire("key") {
+		t.Error("Expected the third acquire to fail")
+	}
+	if !cl.TryAcquire("other") {
+		t.Error("Expected a different key to have its own slots")
+	}
+
+	cl.Release("key")
+	if !cl.TryAcquire("key") {
+		t.Error("Expected a slot after release")
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	clock := newTestClock()
+	cl := NewConcurrencyLimiter(1, time.Second, WithClock(clock))
+	cl.TryAcquire("key")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cl.Acquire(context.Background(), "key")
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	if err := <-done; !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Expected ErrQueueTimeout, got %v", err)
+	}
+}
+
+func TestConcurrencyLimiterQueueRelease(t *testing.T) {
+	clock := newTestClock()
+	cl := NewConcurrencyLimiter(1, time.Second, WithClock(clock))
+	cl.TryAcquire("key")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cl.Acquire(context.Background(), "key")
+	}()
+
+	// The queued request gets the slot as soon as it is released
+	clock.BlockUntil(1)
+	cl.Release("key")
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected queued acquire to succeed, got %v", err)
+	}
+	if cl.InFlight("key") != 1 {
+		t.Errorf("Expected 1 in flight, got %d", cl.InFlight("key"))
+	}
+}
+
+func TestConcurrencyLimiterRemovesIdleKeys(t *testing.T) {
+	cl := NewConcurrencyLimiter(1, 0)
+
+	cl.TryAcquire("key")
+	cl.TryAcquire("key")
+	cl.Release("key")
+	cl.Release("key") // unmatched release is ignored
+
+	if keys := cl.Stats()["active_keys"]; keys != 0 {
+		t.Errorf("Expected no active keys, got %v", keys)
+	}
+}
+
+func TestConcurrencyLimiterConcurrency(t *testing.T) {
+	cl := NewConcurrencyLimiter(3, time.Minute)
+	var inFlight, peak atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cl.Acquire(context.Background(), "key"); err != nil {
+				t.Error(err)
+				return
+			}
+			defer cl.Release("key")
+
+			n := inFlight.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			inFlight.Add(-1)
+		}()
+	}
+
+	wg.Wait()
+
+	if peak.Load() > 3 {
+		t.Errorf("Expected at most 3 in flight, saw %d", peak.Load())
+	}
+}
@@ -0,0 +1,322 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned when a tenant already has the most requests
+// its queue holds
+var ErrQueueFull = errors.New("ratelimit: tenant queue is full")
+
+// ErrQueueStopped is returned to requests still queued when a FairQueue stops
+var ErrQueueStopped = errors.New("ratelimit: fair queue stopped")
+
+// FairQueueConfig configures a FairQueue
+type FairQueueConfig struct {
+	// Weights sets each tenant's relative share of the capacity. A tenant
+	// with weight 3 gets three tokens released for every one released to
+	// a tenant with weight 1 while both have requests waiting.
+	Weights map[string]int64
+
+	// DefaultWeight is the weight of tenants missing from Weights
+	// (defaults to 1)
+	DefaultWeight int64
+
+	// MaxQueue is how many requests a tenant may have waiting before
+	// WaitN fails with ErrQueueFull (0 means unlimited)
+	MaxQueue int
+}
+
+// FairQueue shares a limiter's capacity between tenants. Requests wait in
+// a queue per tenant and are released by deficit round robin: each turn a
+// tenant earns its weight in tokens and releases queued requests while it
+// has earned enough for them. A tenant sending far more than the others
+// only grows its own queue, while the rest keep their share.
+// Safe for concurrent use by multiple goroutines
+type FairQueue struct {
+	limiter Waiter
+	config  FairQueueConfig
+
+	tenants map[string]*tenantQueue
+	active  []*tenantQueue // Tenants with requests waiting, in round robin order
+	next    int            // Index into active of the tenant whose turn it is
+	fresh   bool           // Whether that tenant has yet to earn its weight this turn
+	wake    chan struct{}
+	mu      sync.Mutex
+
+	released uint64
+	rejected uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// tenantQueue holds one tenant's waiting requests
+type tenantQueue struct {
+	name    string
+	weight  int64
+	deficit int64 // Tokens earned but not yet spent this turn
+	reqs    []*fairRequest
+	active  bool
+}
+
+// fairRequest is a request waiting for its turn
+type fairRequest struct {
+	ctx    context.Context
+	n      int64
+	taken  bool       // Whether the dispatcher has picked it up
+	result chan error // Receives nil once released
+}
+
+// NewFairQueue creates a fair queue releasing requests no faster than
+// limiter allows, such as a TokenBucket holding the gateway's total rate.
+// Call Stop to release its goroutine.
+func NewFairQueue(limiter Waiter, config FairQueueConfig) *FairQueue {
+	if config.DefaultWeight <= 0 {
+		config.DefaultWeight = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fq := &FairQueue{
+		limiter: limiter,
+		config:  config,
+		tenants: make(map[string]*tenantQueue),
+		fresh:   true,
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go fq.dispatch()
+	return fq
+}
+
+// Wait waits for one token on behalf of tenant; see WaitN
+func (fq *FairQueue) Wait(ctx context.Context, tenant string) error {
+	return fq.WaitN(ctx, tenant, 1)
+}
+
+// WaitN queues a request for n tokens behind tenant's earlier requests
+// and blocks until it is released. It returns ErrExceedsCapacity if n
+// exceeds the limiter's capacity, ErrQueueFull if tenant's queue is full,
+// or ctx's error if ctx is done first; in those cases nothing is consumed.
+func (fq *FairQueue) WaitN(ctx context.Context, tenant string, n int64) error {
+	if n > fq.limiter.Capacity() {
+		return ErrExceedsCapacity
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	req := &fairRequest{ctx: ctx, n: n, result: make(chan error, 1)}
+	if err := fq.enqueue(tenant, req); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+	}
+
+	fq.mu.Lock()
+	if !req.taken {
+		fq.remove(tenant, req)
+		fq.mu.Unlock()
+		return ctx.Err()
+	}
+	fq.mu.Unlock()
+
+	// The dispatcher is already waiting on the limiter for this request,
+	// and gives up as soon as it notices ctx is done
+	return <-req.result
+}
+
+// enqueue adds req to the back of tenant's queue
+func (fq *FairQueue) enqueue(tenant string, req *fairRequest) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	if fq.ctx.Err() != nil {
+		return ErrQueueStopped
+	}
+
+	tq, exists := fq.tenants[tenant]
+	if !exists {
+		tq = &tenantQueue{name: tenant, weight: fq.weight(tenant)}
+		fq.tenants[tenant] = tq
+	}
+
+	if fq.config.MaxQueue > 0 && len(tq.reqs) >= fq.config.MaxQueue {
+		fq.rejected++
+		return ErrQueueFull
+	}
+
+	tq.reqs = append(tq.reqs, req)
+	if !tq.active {
+		tq.active = true
+		fq.active = append(fq.active, tq)
+	}
+
+	select {
+	case fq.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// remove drops a request that gave up before being picked. Its tenant is
+// cleaned up by pick once its queue is empty.
+// Must be called with lock held
+func (fq *FairQueue) remove(tenant string, req *fairRequest) {
+	tq := fq.tenants[tenant]
+	for i, r := range tq.reqs {
+		if r == req {
+			tq.reqs = append(tq.reqs[:i], tq.reqs[i+1:]...)
+			return
+		}
+	}
+}
+
+// weight returns tenant's configured weight
+func (fq *FairQueue) weight(tenant string) int64 {
+	if w, ok := fq.config.Weights[tenant]; ok && w > 0 {
+		return w
+	}
+	return fq.config.DefaultWeight
+}
+
+// dispatch releases queued requests one at a time, waiting on the limiter
+// for each, until the queue is stopped
+func (fq *FairQueue) dispatch() {
+	defer close(fq.done)
+
+	for {
+		req := fq.pick()
+		if req == nil {
+			select {
+			case <-fq.wake:
+				continue
+			case <-fq.ctx.Done():
+				fq.drain()
+				return
+			}
+		}
+
+		// Wait as long as both the caller and the queue are still around
+		ctx, cancel := context.WithCancel(req.ctx)
+		stop := context.AfterFunc(fq.ctx, cancel)
+		err := fq.limiter.WaitN(ctx, req.n)
+		stop()
+		cancel()
+
+		if err != nil && fq.ctx.Err() != nil && req.ctx.Err() == nil {
+			err = ErrQueueStopped
+		}
+		if err == nil {
+			fq.mu.Lock()
+			fq.released++
+			fq.mu.Unlock()
+		}
+		req.result <- err
+	}
+}
+
+// pick takes the next request to release by deficit round robin, or
+// returns nil if none is waiting
+func (fq *FairQueue) pick() *fairRequest {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	for len(fq.active) > 0 {
+		if fq.next >= len(fq.active) {
+			fq.next = 0
+		}
+		tq := fq.active[fq.next]
+
+		if len(tq.reqs) == 0 {
+			// Idle tenants don't bank credit for later
+			tq.active = false
+			tq.deficit = 0
+			fq.active = append(fq.active[:fq.next], fq.active[fq.next+1:]...)
+			delete(fq.tenants, tq.name)
+			fq.fresh = true
+			continue
+		}
+
+		if fq.fresh {
+			tq.deficit += tq.weight
+			fq.fresh = false
+		}
+
+		if req := tq.reqs[0]; req.n <= tq.deficit {
+			tq.deficit -= req.n
+			tq.reqs = tq.reqs[1:]
+			req.taken = true
+			return req
+		}
+
+		// Not enough earned this turn; move on to the next tenant
+		fq.next++
+		fq.fresh = true
+	}
+	return nil
+}
+
+// drain fails every request still queued once the queue stops
+func (fq *FairQueue) drain() {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	for _, tq := range fq.active {
+		for _, req := range tq.reqs {
+			req.taken = true
+			req.result <- ErrQueueStopped
+		}
+		tq.reqs = nil
+	}
+	fq.active = nil
+	fq.tenants = make(map[string]*tenantQueue)
+}
+
+// Queued returns the number of requests tenant has waiting
+func (fq *FairQueue) Queued(tenant string) int {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	if tq, exists := fq.tenants[tenant]; exists {
+		return len(tq.reqs)
+	}
+	return 0
+}
+
+// Stop releases the dispatching goroutine. Requests still queued fail
+// with ErrQueueStopped.
+func (fq *FairQueue) Stop() {
+	fq.cancel()
+	<-fq.done
+}
+
+// Stats returns statistics about the queue
+func (fq *FairQueue) Stats() map[string]interface{} {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	queued := make(map[string]int, len(fq.tenants))
+	for name, tq := range fq.tenants {
+		if len(tq.reqs) > 0 {
+			queued[name] = len(tq.reqs)
+		}
+	}
+
+	return map[string]interface{}{
+		"active_tenants": len(fq.active),
+		"queued":         queued,
+		"released":       fq.released,
+		"rejected":       fq.rejected,
+		"max_queue":      fq.config.MaxQueue,
+	}
+}
@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit/ratelimittest"
+)
+
+// newBusyFairQueue returns a fair queue releasing one request per second,
+// with its dispatcher already blocked on a request from tenant "first"
+func newBusyFairQueue(t *testing.T, config FairQueueConfig) (*FairQueue, *ratelimittest.Clock, chan string) {
+	t.Helper()
+
+	clock := newTestClock()
+	tb := NewTokenBucket(1, 1, time.Second, WithClock(clock))
+	tb.Allow()
+
+	fq := NewFairQueue(tb, config)
+	t.Cleanup(fq.Stop)
+
+	released := make(chan string, 100)
+	enqueue(fq, "first", 1, released)
+	clock.BlockUntil(1)
+
+	return fq, clock, released
+}
+
+// enqueue starts count requests for tenant, sending tenant to released as each is released
+func enqueue(fq *FairQueue, tenant string, count int, released chan<- string) {
+	for i := 0; i < count; i++ {
+		go func() {
+			if err := fq.Wait(context.Background(), tenant); err == nil {
+				released <- tenant
+			}
+		}()
+	}
+}
+
+// waitQueued waits until tenant has n requests queued
+func waitQueued(t *testing.T, fq *FairQueue, tenant string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for fq.Queued(tenant) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d requests queued for %s, got %d", n, tenant, fq.Queued(tenant))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// releaseOrder advances the clock one release at a time and returns the
+// tenants in the order they were released
+func releaseOrder(clock *ratelimittest.Clock, released <-chan string, count int) []string {
+	order := make([]string, 0, count)
+	for len(order) < count {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		order = append(order, <-released)
+	}
+	return order
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	fq, clock, released := newBusyFairQueue(t, FairQueueConfig{})
+
+	// A heavy tenant queues up first, then a light one
+	enqueue(fq, "heavy", 6, released)
+	waitQueued(t, fq, "heavy", 6)
+	enqueue(fq, "light", 2, released)
+	waitQueued(t, fq, "light", 2)
+
+	got := releaseOrder(clock, released, 9)
+	want := []string{"first", "heavy", "light", "heavy", "light", "heavy", "heavy", "heavy", "heavy"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected release order %v, got %v", want, got)
+		}
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	fq, clock, released := newBusyFairQueue(t, FairQueueConfig{
+		Weights: map[string]int64{"gold": 3},
+	})
+
+	enqueue(fq, "gold", 6, released)
+	waitQueued(t, fq, "gold", 6)
+	enqueue(fq, "bronze", 6, released)
+	waitQueued(t, fq, "bronze", 6)
+
+	got := releaseOrder(clock, released, 10)
+	want := []string{"first", "gold", "gold", "gold", "bronze", "gold", "gold", "gold", "bronze", "bronze"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected release order %v, got %v", want, got)
+		}
+	}
+}
+
+func TestFairQueueFull(t *testing.T) {
+	fq, _, released := newBusyFairQueue(t, FairQueueConfig{MaxQueue: 2})
+
+	enqueue(fq, "tenant", 2, released)
+	waitQueued(t, fq, "tenant", 2)
+
+	if err := fq.Wait(context.Background(), "tenant"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	// Other tenants have their own queues
+	errs := make(chan error, 1)
+	go func() { errs <- fq.Wait(context.Background(), "other") }()
+	waitQueued(t, fq, "other", 1)
+
+	if rejected := fq.Stats()["rejected"].(uint64); rejected != 1 {
+		t.Errorf("Expected 1 rejected request, got %d", rejected)
+	}
+}
+
+func TestFairQueueExceedsCapacity(t *testing.T) {
+	fq := NewFairQueue(NewTokenBucket(5, 5, time.Second), FairQueueConfig{})
+	defer fq.Stop()
+
+	if err := fq.WaitN(context.Background(), "tenant", 6); !errors.Is(err, ErrExceedsCapacity) {
+		t.Errorf("Expected ErrExceedsCapacity, got %v", err)
+	}
+}
+
+func TestFairQueueCancelled(t *testing.T) {
+	fq, clock, released := newBusyFairQueue(t, FairQueueConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- fq.Wait(ctx, "tenant") }()
+	waitQueued(t, fq, "tenant", 1)
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if n := fq.Queued("tenant"); n != 0 {
+		t.Errorf("Expected the cancelled request to leave the queue, %d still queued", n)
+	}
+
+	// The queue carries on without it
+	enqueue(fq, "other", 1, released)
+	waitQueued(t, fq, "other", 1)
+	if got := releaseOrder(clock, released, 2); got[1] != "other" {
+		t.Errorf("Expected other to be released after first, got %v", got)
+	}
+}
+
+func TestFairQueueStop(t *testing.T) {
+	fq, _, _ := newBusyFairQueue(t, FairQueueConfig{})
+
+	errs := make(chan error, 1)
+	go func() { errs <- fq.Wait(context.Background(), "tenant") }()
+	waitQueued(t, fq, "tenant", 1)
+
+	fq.Stop()
+	if err := <-errs; !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("Expected ErrQueueStopped, got %v", err)
+	}
+	if err := fq.Wait(context.Background(), "tenant"); !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("Expected ErrQueueStopped after Stop, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// GCRA implements the generic cell rate algorithm. Instead of counting tokens
+// it tracks the theoretical arrival time (TAT) of the next request: each
+// admitted request pushes the TAT forward by one emission interval, and a
+// request is rejected if that would put the TAT further ahead than the burst
+// allows. Requests are spaced evenly with a single timestamp of state.
+// Safe for concurrent use by multiple goroutines
+type GCRA struct {
+	burst    int64         // Maximum requests admitted back to back
+	emission time.Duration // Time between requests at the sustained rate
+	refills  bool          // Whether requests are earned back; false if the rate is 0
+	tat      time.Time     // Theoretical arrival time of the next request
+	clock    Clock
+	mu       sync.Mutex
+}
+
+// NewGCRA creates a GCRA limiter
+// burst: maximum number of requests admitted at once
+// rate: number of requests allowed per interval once the burst is spent
+// interval: the period rate is measured over
+// A rate of 0 never earns requests back, so once the burst is used every
+// request is rejected.
+func NewGCRA(burst, rate int64, interval time.Duration, opts ...Option) *GCRA {
+	return newGCRA(burst, rate, interval, newOptions(opts))
+}
+
+func newGCRA(burst, rate int64, interval time.Duration, o options) *GCRA {
+	g := &GCRA{burst: burst, clock: o.clock}
+	g.emission, g.refills = emissionFor(rate, interval)
+	g.tat = g.now()
+	return g
+}
+
+// frozenTime stands in for the current time in limiters that never earn
+// requests back. Their state is measured against it instead of the clock,
+// so it doesn't age, and snapshots of it stay valid in another process.
+// It lies far ahead so that such state kept in a Store never expires.
+var frozenTime = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// emissionFor returns the time to earn one request at rate per interval,
+// and whether requests are earned at all. A rate of 0 or less never earns
+// them: requests then cost a nanosecond each against frozenTime.
+func emissionFor(rate int64, interval time.Duration) (time.Duration, bool) {
+	if rate <= 0 {
+		return time.Nanosecond, false
+	}
+	return max(interval/time.Duration(rate), time.Nanosecond), true
+}
+
+// now returns the time the TAT is measured against
+func (g *GCRA) now() time.Time {
+	if !g.refills {
+		return frozenTime
+	}
+	return g.clock.Now()
+}
+
+// Allow checks if a request can proceed and records it if so
+func (g *GCRA) Allow() bool {
+	return g.AllowN(1)
+}
+
+// AllowN checks if n requests conform to the rate and records them if so
+func (g *GCRA) AllowN(n int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(time.Duration(n) * g.emission)
+	if newTat.Sub(now) > g.tolerance() {
+		return false
+	}
+
+	g.tat = newTat
+	return true
+}
+
+// tolerance is how far ahead of now the TAT may run
+func (g *GCRA) tolerance() time.Duration {
+	return time.Duration(g.burst) * g.emission
+}
+
+// Available returns how many requests could be admitted right now
+func (g *GCRA) Available() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ahead := g.tat.Sub(g.now())
+	if ahead <= 0 {
+		return g.burst
+	}
+
+	available := int64((g.tolerance() - ahead) / g.emission)
+	if available < 0 {
+		// Reservations have booked requests beyond the burst
+		return 0
+	}
+	return available
+}
+
+// TimeUntil returns how long until n requests would conform, or 0 if they
+// already do. It returns InfDuration if n exceeds the burst, or if they
+// never will because the rate is 0.
+func (g *GCRA) TimeUntil(n int64) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.delayFor(n, g.now())
+}
+
+// delayFor returns how long after now n requests would conform
+// Must be called with lock held
+func (g *GCRA) delayFor(n int64, now time.Time) time.Duration {
+	if n > g.burst {
+		return InfDuration
+	}
+
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	delay := tat.Add(time.Duration(n)*g.emission).Sub(now) - g.tolerance()
+	if delay <= 0 {
+		return 0
+	}
+	if !g.refills {
+		return InfDuration
+	}
+	return delay
+}
+
+// Reserve reserves a single request; see ReserveN
+func (g *GCRA) Reserve() *Reservation {
+	return g.ReserveN(1)
+}
+
+// ReserveN books n requests at the earliest time they conform and returns
+// a reservation saying how long the caller must wait. The reservation is
+// not OK if n exceeds the burst, or will never conform because the rate is 0.
+func (g *GCRA) ReserveN(n int64) *Reservation {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	delay := g.delayFor(n, now)
+	if delay == InfDuration {
+		return &Reservation{}
+	}
+
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	g.tat = g.tat.Add(time.Duration(n) * g.emission)
+
+	return &Reservation{
+		ok:        true,
+		tokens:    n,
+		timeToAct: now.Add(delay),
+		clock:     g.clock,
+		cancel:    func() { g.refund(n) },
+	}
+}
+
+// refund gives back n requests, such as those booked by a cancelled reservation
+func (g *GCRA) refund(n int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tat = g.tat.Add(-time.Duration(n) * g.emission)
+}
+
+// state returns the theoretical arrival time
+func (g *GCRA) state() bucketState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return bucketState{At: g.tat}
+}
+
+// setState restores the theoretical arrival time saved by state
+func (g *GCRA) setState(s bucketState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tat = s.At
+}
+
+// Wait blocks until a request conforms; see WaitN
+func (g *GCRA) Wait(ctx context.Context) error {
+	return g.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n requests conform and records them. It returns an
+// error if n exceeds the burst, ctx is cancelled, or the wait would last
+// past ctx's deadline; in those cases nothing is recorded.
+func (g *GCRA) WaitN(ctx context.Context, n int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return waitReservation(ctx, g.ReserveN(n))
+}
+
+// reconfigure applies new limits, keeping the used requests or, with
+// rescale, their share of the burst
+func (g *GCRA) reconfigure(p Policy, rescale bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// How far ahead the TAT runs is the requests used, in emission intervals
+	used := float64(g.tat.Sub(g.now())) / float64(g.emission)
+	oldBurst := g.burst
+
+	g.burst = p.Capacity
+	g.emission, g.refills = emissionFor(p.RefillRate, p.Interval)
+
+	g.tat = g.now()
+	if used > 0 {
+		g.tat = g.tat.Add(time.Duration(carryShare(used, oldBurst, g.burst, rescale) * float64(g.emission)))
+	}
+}
+
+// Capacity returns the maximum burst size
+func (g *GCRA) Capacity() int64 {
+	return g.burst
+}
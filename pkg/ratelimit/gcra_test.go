@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCRABurst(t *testing.T) {
+	g := NewGCRA(5, 5, time.Minute)
+
+	if g.Available() != 5 {
+		t.Errorf("Expected 5 available, got %d", g.Available())
+	}
+
+	for i := 0; i < 5; i++ {
+		if !g.Allow() {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+
+	if g.Allow() {
+		t.Error("Request 6 should be denied")
+	}
+
+	if g.Available() != 0 {
+		t.Errorf("Expected 0 available, got %d", g.Available())
+	}
+}
+
+func TestGCRAAllowN(t *testing.T) {
+	g := NewGCRA(10, 10, time.Minute)
+
+	if !g.AllowN(6) {
+		t.Error("AllowN(6) should succeed")
+	}
+
+	if g.AllowN(5) {
+		t.Error("AllowN(5) should fail - only 4 left")
+	}
+
+	if !g.AllowN(4) {
+		t.Error("AllowN(4) should succeed")
+	}
+}
+
+func TestGCRAEmission(t *testing.T) {
+	clock := newTestClock()
+	// One request every 50ms, no burst beyond a single request
+	g := NewGCRA(1, 20, time.Second, WithClock(clock))
+
+	if !g.Allow() {
+		t.Fatal("First request should be allowed")
+	}
+	if g.Allow() {
+		t.Error("Second request should be denied until the emission interval passes")
+	}
+
+	if wait := g.TimeUntil(1); wait != 50*time.Millisecond {
+		t.Errorf("Expected to wait one emission interval, got %v", wait)
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	if !g.Allow() {
+		t.Error("Request should be allowed after the emission interval")
+	}
+}
+
+func TestGCRAZeroRate(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(10, 0, time.Minute, WithClock(clock), WithAlgorithm(GCRAAlgorithm))
+
+	if !limiter.AllowN("x", 10) {
+		t.Fatal("Expected the burst to be allowed")
+	}
+	if limiter.Allow("x") {
+		t.Error("Request should be denied once the burst is used")
+	}
+
+	clock.Advance(24 * time.Hour)
+	if limiter.Allow("x") {
+		t.Error("Requests should never be earned back with a rate of 0")
+	}
+
+	limiter.Update(10, 10, 0)
+	clock.Advance(6 * time.Second)
+	if !limiter.Allow("x") || limiter.Allow("x") {
+		t.Error("Expected one request earned back once a rate is set")
+	}
+
+	g := NewGCRA(2, 0, time.Minute, WithClock(clock))
+	g.Allow()
+	if g.Available() != 1 {
+		t.Errorf("Expected 1 available, got %d", g.Available())
+	}
+	if wait := g.TimeUntil(2); wait != InfDuration {
+		t.Errorf("Expected to wait forever, got %v", wait)
+	}
+	if !g.Reserve().OK() || g.Reserve().OK() {
+		t.Error("Expected one reservation to be granted and the next refused")
+	}
+}
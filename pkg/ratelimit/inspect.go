@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// KeyInfo describes the current state of a key in a Limiter
+type KeyInfo struct {
+	Key    string
+	Policy Policy
+
+	// Remaining is the number of requests the key could make right now
+	Remaining int64
+
+	// Capacity is the key's maximum burst, or its limit per window
+	Capacity int64
+
+	// NextRefill is when the key's next request becomes available, or the
+	// zero time if its allowance is already full
+	NextRefill time.Time
+
+	// ResetAt is when the key's allowance will be full again, or the zero
+	// time if it already is
+	ResetAt time.Time
+
+	// LastSeen is when the key last made a request
+	LastSeen time.Time
+
+	// Allowed and Denied count the key's requests since it was added.
+	// They start over if the key is cleaned up or evicted.
+	Allowed uint64
+	Denied  uint64
+}
+
+// Inspector is implemented by rate limiters that can report a key's state
+type Inspector interface {
+	// Inspect returns the state of key, or false if it isn't tracked
+	Inspect(key string) (KeyInfo, bool)
+}
+
+// Inspect returns the state of key without counting as a request, or false
+// if the key isn't tracked (such as a key that hasn't made a request, or
+// whose allowance refilled and was cleaned up). With a Store, it reports
+// the key's bucket in the store as of its last request, refilled since,
+// unless the local fallback bucket has fewer requests left.
+func (l *Limiter) Inspect(key string) (KeyInfo, bool) {
+	e, exists := l.shardFor(key).lookup(key)
+	if !exists {
+		return KeyInfo{}, false
+	}
+	return l.info(e), true
+}
+
+// info builds the KeyInfo for an entry
+func (l *Limiter) info(e *entry) KeyInfo {
+	now := l.opts.clock.Now()
+	b := e.bucket
+
+	info := KeyInfo{
+		Key:       e.key,
+		Policy:    e.policy,
+		Remaining: b.Available(),
+		Capacity:  b.Capacity(),
+		LastSeen:  time.Unix(0, e.lastSeen.Load()),
+		Allowed:   e.allowed.Load(),
+		Denied:    e.denied.Load(),
+	}
+
+	if info.Remaining < info.Capacity {
+		info.NextRefill = now.Add(b.TimeUntil(info.Remaining + 1))
+		info.ResetAt = now.Add(b.TimeUntil(info.Capacity))
+	}
+
+	if s := e.stored.Load(); s != nil {
+		if remaining := s.available(now); remaining < info.Remaining {
+			info.Remaining = remaining
+			info.NextRefill = now.Add(s.timeUntil(remaining+1, now))
+		}
+		if resetAt := now.Add(s.timeUntil(s.policy.Capacity, now)); resetAt.After(now) && resetAt.After(info.ResetAt) {
+			info.ResetAt = resetAt
+		}
+	}
+	return info
+}
+
+// Keys returns up to limit tracked keys in sorted order, starting after
+// cursor ("" for the first page), and the cursor for the next page, which
+// is "" after the last page. A limit of 0 or less returns every key after
+// cursor. Keys added or removed while paging may be missed or seen once
+// more. Keys aren't kept in order, so each page scans every tracked key;
+// paging through many keys is cheaper in fewer, larger pages.
+func (l *Limiter) Keys(cursor string, limit int) (keys []string, next string) {
+	// Keep the first limit keys after cursor, largest on top
+	page := &keyHeap{}
+	more := false
+	for _, s := range l.shards {
+		s.mu.RLock()
+		for key := range s.entries {
+			switch {
+			case key <= cursor:
+			case limit <= 0 || page.Len() < limit:
+				heap.Push(page, key)
+			case key < (*page)[0]:
+				(*page)[0] = key
+				heap.Fix(page, 0)
+				more = true
+			default:
+				more = true
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	keys = *page
+	sort.Strings(keys)
+	if more {
+		next = keys[len(keys)-1]
+	}
+	return keys, next
+}
+
+// keyHeap is a max-heap of keys
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(string))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+// TopThrottled returns the n tracked keys with the most denied requests,
+// most denied first, or all of them if n is 0 or less. Keys that haven't
+// been denied are left out.
+func (l *Limiter) TopThrottled(n int) []KeyInfo {
+	var throttled []*entry
+	for _, s := range l.shards {
+		s.mu.RLock()
+		for _, e := range s.entries {
+			if e.denied.Load() > 0 {
+				throttled = append(throttled, e)
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	denied := make(map[*entry]uint64, len(throttled))
+	for _, e := range throttled {
+		denied[e] = e.denied.Load()
+	}
+	sort.Slice(throttled, func(i, j int) bool {
+		if denied[throttled[i]] != denied[throttled[j]] {
+			return denied[throttled[i]] > denied[throttled[j]]
+		}
+		return throttled[i].key < throttled[j].key
+	})
+
+	if n > 0 && len(throttled) > n {
+		throttled = throttled[:n]
+	}
+
+	infos := make([]KeyInfo, len(throttled))
+	for i, e := range throttled {
+		infos[i] = l.info(e)
+	}
+	return infos
+}
@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLimiterInspect(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(3, 1, time.Second, WithClock(clock), WithRefillMode(RefillContinuous))
+
+	if _, ok := limiter.Inspect("key"); ok {
+		t.Error("Expected an unknown key not to be tracked")
+	}
+
+	limiter.AllowN("key", 3)
+	limiter.Allow("key")
+	clock.Advance(500 * time.Millisecond)
+
+	info, ok := limiter.Inspect("key")
+	if !ok {
+		t.Fatal("Expected the key to be tracked")
+	}
+	if info.Remaining != 0 || info.Capacity != 3 {
+		t.Errorf("Expected 0 of 3 remaining, got %d of %d", info.Remaining, info.Capacity)
+	}
+	if want := clock.Now().Add(500 * time.Millisecond); !info.NextRefill.Equal(want) {
+		t.Errorf("Expected next refill at %v, got %v", want, info.NextRefill)
+	}
+	if want := clock.Now().Add(2500 * time.Millisecond); !info.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at %v, got %v", want, info.ResetAt)
+	}
+	if want := clock.Now().Add(-500 * time.Millisecond); !info.LastSeen.Equal(want) {
+		t.Errorf("Expected last seen at %v, got %v", want, info.LastSeen)
+	}
+	if info.Allowed != 1 || info.Denied != 1 {
+		t.Errorf("Expected 1 allowed and 1 denied, got %d and %d", info.Allowed, info.Denied)
+	}
+
+	// Inspecting doesn't count as a request
+	limiter.Inspect("key")
+	if info, _ := limiter.Inspect("key"); !info.LastSeen.Equal(clock.Now().Add(-500 * time.Millisecond)) {
+		t.Error("Expected Inspect not to update last seen")
+	}
+}
+
+func TestLimiterInspectCountsWaits(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"reservation": {WithAlgorithm(TokenBucketAlgorithm)},
+		"poll":        {WithAlgorithm(SlidingWindowLogAlgorithm)},
+		"store":       {WithStore(NewMemoryStore())},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := newTestClock()
+			limiter := NewLimiter(1, 1, time.Second, append(opts, WithClock(clock))...)
+			limiter.Allow("key")
+			limiter.Allow("key")
+
+			done := make(chan error, 1)
+			go func() {
+				done <- limiter.Wait(context.Background(), "key")
+			}()
+			clock.BlockUntil(1)
+			clock.Advance(time.Second)
+			if err := <-done; err != nil {
+				t.Fatalf("Expected the wait to succeed, got %v", err)
+			}
+
+			info, _ := limiter.Inspect("key")
+			if info.Allowed != 2 || info.Denied != 1 {
+				t.Errorf("Expected the wait to count as allowed, got %d allowed and %d denied", info.Allowed, info.Denied)
+			}
+			if !info.LastSeen.Equal(clock.Now()) {
+				t.Errorf("Expected last seen to move to the admission, got %v", info.LastSeen)
+			}
+		})
+	}
+
+	clock := newTestClock()
+	limiter := NewLimiter(1, 1, time.Second, WithClock(clock))
+	limiter.Reserve("key")
+	if info, _ := limiter.Inspect("key"); info.Allowed != 1 {
+		t.Errorf("Expected a reservation to count as allowed, got %d", info.Allowed)
+	}
+}
+
+func TestLimiterKeysPaging(t *testing.T) {
+	limiter := NewLimiter(10, 10, time.Minute)
+	for i := 0; i < 25; i++ {
+		limiter.Allow(fmt.Sprintf("key-%02d", i))
+	}
+
+	var all []string
+	cursor := ""
+	pages := 0
+	for {
+		keys, next := limiter.Keys(cursor, 10)
+		all = append(all, keys...)
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if pages != 3 || len(all) != 25 {
+		t.Fatalf("Expected 25 keys over 3 pages, got %d over %d", len(all), pages)
+	}
+	for i, key := range all {
+		if want := fmt.Sprintf("key-%02d", i); key != want {
+			t.Fatalf("Expected %s at %d, got %s", want, i, key)
+		}
+	}
+}
+
+func TestLimiterKeysLastPage(t *testing.T) {
+	limiter := NewLimiter(10, 10, time.Minute)
+	for i := 0; i < 20; i++ {
+		limiter.Allow(fmt.Sprintf("key-%02d", i))
+	}
+
+	if keys, next := limiter.Keys("", 10); len(keys) != 10 || next != "key-09" {
+		t.Fatalf("Expected the first 10 keys, got %v and cursor %q", keys, next)
+	}
+	if keys, next := limiter.Keys("key-09", 10); len(keys) != 10 || keys[0] != "key-10" || next != "" {
+		t.Errorf("Expected the last 10 keys and no cursor, got %v and cursor %q", keys, next)
+	}
+	if keys, next := limiter.Keys("key-14", 0); len(keys) != 5 || next != "" {
+		t.Errorf("Expected every key after the cursor, got %v and cursor %q", keys, next)
+	}
+}
+
+func TestLimiterTopThrottled(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute)
+
+	for key, requests := range map[string]int{"heavy": 10, "medium": 5, "light": 1, "quiet": 2} {
+		for i := 0; i < requests; i++ {
+			limiter.Allow(key)
+		}
+	}
+
+	top := limiter.TopThrottled(2)
+	if len(top) != 2 || top[0].Key != "heavy" || top[1].Key != "medium" {
+		t.Fatalf("Expected heavy then medium, got %+v", top)
+	}
+	if top[0].Denied != 9 {
+		t.Errorf("Expected 9 denials for heavy, got %d", top[0].Denied)
+	}
+
+	if all := limiter.TopThrottled(10); len(all) != 3 {
+		t.Errorf("Expected keys without denials to be left out, got %d keys", len(all))
+	}
+	for _, n := range []int{0, -1} {
+		if all := limiter.TopThrottled(n); len(all) != 3 {
+			t.Errorf("Expected TopThrottled(%d) to return every throttled key, got %d", n, len(all))
+		}
+	}
+}
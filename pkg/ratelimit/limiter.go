@@ -1,120 +1,430 @@
 package ratelimit
 
 import (
+	"context"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// RateLimiter is implemented by rate limiters that track limits per key.
+// Middleware and the gateway depend on this interface rather than on a
+// specific algorithm.
+type RateLimiter interface {
+	// Allow checks if a request for the given key is allowed
+	Allow(key string) bool
+
+	// AllowN checks if n requests for the given key are allowed
+	AllowN(key string, n int64) bool
+
+	// Reset clears the rate limit state for the given key
+	Reset(key string)
+
+	// Stats returns statistics about the limiter
+	Stats() map[string]interface{}
+}
+
+// bucket is the per-key state kept by a Limiter. TokenBucket,
+// AtomicTokenBucket, SlidingWindowLog, SlidingWindowCounter and GCRA
+// implement it.
+type bucket interface {
+	AllowN(n int64) bool
+	Available() int64
+	Capacity() int64
+	TimeUntil(n int64) time.Duration
+
+	// reconfigure applies new limits. With rescale, the key keeps the same
+	// used share of its allowance; otherwise it keeps the same number of
+	// used requests, up to the new capacity.
+	reconfigure(p Policy, rescale bool)
+
+	// refund gives back n requests taken by AllowN
+	refund(n int64)
+
+	// state and setState save and restore the bucket for snapshots
+	state() bucketState
+	setState(s bucketState)
+}
+
 // Limiter manages rate limits for multiple keys (e.g., IP addresses, API keys)
-// Uses token bucket algorithm for each key
+// Uses the token bucket algorithm for each key unless WithAlgorithm selects another.
+// Keys are spread across shards with independent locks, so new keys and
+// cleanup in one shard don't stall requests in the others.
 type Limiter struct {
-	buckets    map[string]*TokenBucket
-	mu         sync.RWMutex
-	capacity   int64
-	refillRate int64
-	interval   time.Duration
+	shards          []*shard
+	seed            maphash.Seed
+	policy          Policy // Applied to keys without their own policy
 	cleanupInterval time.Duration
-	lastCleanup time.Time
+	overrides       map[string]Policy // Policies set with SetPolicy
+	policyMu        sync.RWMutex      // Guards policy and overrides
+	opts            options
+	stop            chan struct{}
+	stopOnce        sync.Once
+	checkpointDone  chan struct{} // Closed once the final checkpoint is written
+	storeErrors     atomic.Uint64 // Store calls that failed and fell back to local buckets
 }
 
 // NewLimiter creates a new multi-key rate limiter
-func NewLimiter(capacity, refillRate int64, interval time.Duration) *Limiter {
-	return &Limiter{
-		buckets:         make(map[string]*TokenBucket),
-		capacity:        capacity,
-		refillRate:      refillRate,
-		interval:        interval,
+// For the window algorithms capacity is the limit per window, and the window
+// is the time a full refill takes (interval when capacity equals refillRate)
+func NewLimiter(capacity, refillRate int64, interval time.Duration, opts ...Option) *Limiter {
+	o := newOptions(opts)
+	l := &Limiter{
+		shards:          make([]*shard, o.shards),
+		seed:            maphash.MakeSeed(),
+		policy:          Policy{Name: "default", Capacity: capacity, RefillRate: refillRate, Interval: interval},
 		cleanupInterval: 5 * time.Minute,
-		lastCleanup:     time.Now(),
+		overrides:       make(map[string]Policy),
+		opts:            o,
+		stop:            make(chan struct{}),
+	}
+
+	// Spread the key limit evenly, rounding up so the total is at least maxKeys
+	shardKeys := 0
+	if o.maxKeys > 0 {
+		shardKeys = (o.maxKeys + o.shards - 1) / o.shards
+	}
+
+	now := o.clock.Now()
+	for i := range l.shards {
+		l.shards[i] = newShard(now, shardKeys)
 	}
+
+	if o.janitorInterval > 0 {
+		l.cleanupInterval = o.janitorInterval
+		go l.janitor()
+	}
+
+	if o.checkpointPath != "" && o.checkpointInterval > 0 {
+		l.checkpointDone = make(chan struct{})
+		go l.checkpoint()
+	}
+
+	return l
 }
 
 // Allow checks if a request for the given key is allowed
 func (l *Limiter) Allow(key string) bool {
-	bucket := l.getBucket(key)
-	return bucket.Allow()
+	return l.AllowN(key, 1)
 }
 
 // AllowN checks if n requests for the given key are allowed
 func (l *Limiter) AllowN(key string, n int64) bool {
-	bucket := l.getBucket(key)
-	return bucket.AllowN(n)
+	if l.opts.store != nil {
+		result, e, err := l.takeFromStore(context.Background(), key, n)
+		if err == nil {
+			e.record(result.Allowed)
+			return result.Allowed
+		}
+	}
+	e := l.getEntry(key)
+	allowed := e.bucket.AllowN(n)
+	e.record(allowed)
+	return allowed
 }
 
-// getBucket returns or creates a token bucket for the given key
-func (l *Limiter) getBucket(key string) *TokenBucket {
-	// Fast path: read lock for existing bucket
-	l.mu.RLock()
-	bucket, exists := l.buckets[key]
-	l.mu.RUnlock()
+// Refund gives back n requests for the given key that were taken by
+// AllowN but not used, such as when another limit rejected the request
+func (l *Limiter) Refund(key string, n int64) {
+	if l.opts.store != nil {
+		if _, _, err := l.takeFromStore(context.Background(), key, -n); err == nil {
+			return
+		}
+	}
+	if e, exists := l.shardFor(key).get(key, l.opts.clock.Now()); exists {
+		e.bucket.refund(n)
+	}
+}
 
-	if exists {
-		return bucket
+// KeyWaiter is implemented by rate limiters that can block until a key's
+// requests are allowed, such as Limiter and AdaptiveLimiter
+type KeyWaiter interface {
+	WaitN(ctx context.Context, key string, n int64) error
+}
+
+// Wait blocks until a request for the given key is allowed; see WaitN
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+	return l.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for the given key are allowed and consumes
+// them. It returns an error if n exceeds capacity, ctx is cancelled, or the
+// wait would last past ctx's deadline.
+func (l *Limiter) WaitN(ctx context.Context, key string, n int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l.opts.store != nil {
+		return l.waitStore(ctx, key, n)
 	}
+	return l.waitEntry(ctx, l.getEntry(key), n)
+}
 
-	// Slow path: write lock to create new bucket
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// waitEntry blocks until n requests are allowed by e's bucket
+func (l *Limiter) waitEntry(ctx context.Context, e *entry, n int64) error {
+	var err error
+	if r, ok := e.bucket.(reserver); ok {
+		err = waitReservation(ctx, r.ReserveN(n))
+	} else {
+		err = waitPoll(ctx, l.opts.clock, e.bucket, n)
+	}
+	if err == nil {
+		l.admitted(e)
+	}
+	return err
+}
+
+// admitted counts a request for e allowed by waiting or a reservation,
+// which may be well after the entry was first looked up
+func (l *Limiter) admitted(e *entry) {
+	e.touch(l.opts.clock.Now())
+	e.record(true)
+}
+
+// Reserve reserves a request for the given key; see ReserveN
+func (l *Limiter) Reserve(key string) *Reservation {
+	return l.ReserveN(key, 1)
+}
+
+// ReserveN takes n tokens for the given key ahead of time and returns a
+// reservation saying how long to wait before acting. Only the token bucket
+// and GCRA algorithms can reserve; with the window algorithms, with a
+// Store, and when n exceeds capacity, the reservation is not OK. Use WaitN
+// to block with any algorithm.
+func (l *Limiter) ReserveN(key string, n int64) *Reservation {
+	if l.opts.store != nil {
+		return &Reservation{}
+	}
+	e := l.getEntry(key)
+	if r, ok := e.bucket.(reserver); ok {
+		res := r.ReserveN(n)
+		if res.OK() {
+			l.admitted(e)
+		}
+		return res
+	}
+	return &Reservation{}
+}
+
+// shardFor returns the shard that owns the given key
+func (l *Limiter) shardFor(key string) *shard {
+	return l.shards[maphash.String(l.seed, key)%uint64(len(l.shards))]
+}
+
+// getEntry returns or creates the entry holding the bucket for the given key
+func (l *Limiter) getEntry(key string) *entry {
+	s := l.shardFor(key)
+	now := l.opts.clock.Now()
+
+	// Fast path: existing bucket
+	if e, exists := s.get(key, now); exists {
+		return e
+	}
+
+	// Slow path: write lock on this shard only to create new bucket
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	// Double-check after acquiring write lock
-	bucket, exists = l.buckets[key]
-	if exists {
-		return bucket
+	if e, exists := s.entries[key]; exists {
+		e.touch(now)
+		return e
+	}
+
+	// Without a janitor, opportunistically cleanup this shard, before adding
+	// the new bucket so that it can't be swept up while still full
+	if l.opts.janitorInterval <= 0 {
+		s.cleanupIfNeeded(now, l.cleanupInterval, l.opts.idleTTL)
+	}
+
+	// Create new bucket, evicting the least recently used key if bounded
+	p := l.resolvePolicy(key)
+	return s.add(key, l.newBucket(p), p, now)
+}
+
+// newBucket creates per-key state for the configured algorithm
+func (l *Limiter) newBucket(p Policy) bucket {
+	switch l.opts.algorithm {
+	case SlidingWindowLogAlgorithm:
+		return newSlidingWindowLog(p.Capacity, p.Window(), l.opts)
+	case SlidingWindowCounterAlgorithm:
+		return newSlidingWindowCounter(p.Capacity, p.Window(), l.opts)
+	case GCRAAlgorithm:
+		return newGCRA(p.Capacity, p.RefillRate, p.Interval, l.opts)
+	case AtomicTokenBucketAlgorithm:
+		return newAtomicTokenBucket(p.Capacity, p.RefillRate, p.Interval, l.opts)
+	default:
+		return newTokenBucket(p.Capacity, p.RefillRate, p.Interval, l.opts)
+	}
+}
+
+// resolvePolicy returns the policy for a new key: one set with SetPolicy,
+// then the resolver's answer, then the default policy
+func (l *Limiter) resolvePolicy(key string) Policy {
+	l.policyMu.RLock()
+	p, ok := l.overrides[key]
+	defaults := l.policy
+	l.policyMu.RUnlock()
+
+	if !ok && l.opts.resolver != nil {
+		p, ok = l.opts.resolver(key)
+	}
+	if !ok {
+		return defaults
+	}
+	return p.withDefaults(defaults)
+}
+
+// defaultPolicy returns the policy applied to keys without their own
+func (l *Limiter) defaultPolicy() Policy {
+	l.policyMu.RLock()
+	defer l.policyMu.RUnlock()
+
+	return l.policy
+}
+
+// Update changes the default limits while the limiter is running, such as
+// to tune the gateway during an incident. Existing keys are reconfigured in
+// place and keep the same used share of their allowance, so no client gets
+// a fresh quota or loses one. Zero arguments keep the current value. Keys
+// with a policy from SetPolicy or the resolver keep it, apart from fields
+// they took from the default.
+func (l *Limiter) Update(capacity, refillRate int64, interval time.Duration) {
+	l.policyMu.Lock()
+	l.policy = Policy{
+		Name:       l.policy.Name,
+		Capacity:   capacity,
+		RefillRate: refillRate,
+		Interval:   interval,
+	}.withDefaults(l.policy)
+	l.policyMu.Unlock()
+
+	// Keys created before the change are reconfigured under their shard's
+	// lock, so none can be added with the old policy and missed
+	for _, s := range l.shards {
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if p := l.resolvePolicy(key); p != e.policy {
+				e.policy = p
+				e.bucket.reconfigure(p, true)
+			}
+		}
+		s.mu.Unlock()
 	}
+}
 
-	// Create new bucket
-	bucket = NewTokenBucket(l.capacity, l.refillRate, l.interval)
-	l.buckets[key] = bucket
+// SetPolicy changes the policy for a key at runtime, such as when a customer
+// changes plan. The key's current bucket keeps the requests it has used
+// rather than being reset, up to the new capacity, and the policy is
+// remembered for the key if its bucket is later cleaned up. Zero fields in p are taken from the
+// limiter's default policy, and follow it when it changes with Update.
+func (l *Limiter) SetPolicy(key string, p Policy) {
+	l.policyMu.Lock()
+	l.overrides[key] = p
+	l.policyMu.Unlock()
 
-	// Opportunistically cleanup old buckets
-	l.cleanupIfNeeded()
+	l.shardFor(key).setPolicy(key, l.resolvePolicy(key))
+}
 
-	return bucket
+// ClearPolicy removes a policy set with SetPolicy, so the key goes back to
+// the resolver or default policy. The key's current bucket is reconfigured,
+// keeping the requests it has used as SetPolicy does.
+func (l *Limiter) ClearPolicy(key string) {
+	l.policyMu.Lock()
+	delete(l.overrides, key)
+	l.policyMu.Unlock()
+
+	l.shardFor(key).setPolicy(key, l.resolvePolicy(key))
 }
 
-// cleanupIfNeeded removes buckets that are at full capacity (inactive)
-// Must be called with write lock held
-func (l *Limiter) cleanupIfNeeded() {
-	now := time.Now()
-	if now.Sub(l.lastCleanup) < l.cleanupInterval {
-		return
+// Policy returns the policy that applies to a key
+func (l *Limiter) Policy(key string) Policy {
+	if p, exists := l.shardFor(key).policy(key); exists {
+		return p
 	}
+	return l.resolvePolicy(key)
+}
 
-	for key, bucket := range l.buckets {
-		// Remove buckets that are full (haven't been used recently)
-		if bucket.Available() == bucket.Capacity() {
-			delete(l.buckets, key)
+// janitor removes idle buckets in the background until Stop is called.
+// Shards are swept one at a time so only one shard is ever locked.
+func (l *Limiter) janitor() {
+	for {
+		select {
+		case <-l.opts.clock.After(l.cleanupInterval):
+			for _, s := range l.shards {
+				s.sweep(l.opts.clock.Now(), l.opts.idleTTL)
+			}
+		case <-l.stop:
+			return
 		}
 	}
+}
 
-	l.lastCleanup = now
+// Stop stops the background janitor started by WithJanitor, and writes a
+// final checkpoint if WithCheckpoint is set before returning.
+// It is safe to call more than once, and does nothing without either.
+func (l *Limiter) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+	if l.checkpointDone != nil {
+		<-l.checkpointDone
+	}
+}
+
+// keyCount returns the number of keys across all shards
+func (l *Limiter) keyCount() int {
+	total := 0
+	for _, s := range l.shards {
+		total += s.len()
+	}
+	return total
+}
+
+// evictions returns the number of keys evicted to stay under the key
+// limit, and the number dropped after sitting idle for the idle TTL
+func (l *Limiter) evictions() (lru, ttl uint64) {
+	for _, s := range l.shards {
+		lru += s.lruEvictions.Load()
+		ttl += s.ttlEvictions.Load()
+	}
+	return lru, ttl
 }
 
 // Stats returns statistics about the limiter
 func (l *Limiter) Stats() map[string]interface{} {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+	lruEvictions, ttlEvictions := l.evictions()
+	policy := l.defaultPolicy()
 
 	return map[string]interface{}{
-		"total_keys":   len(l.buckets),
-		"capacity":     l.capacity,
-		"refill_rate":  l.refillRate,
-		"interval_ms":  l.interval.Milliseconds(),
+		"total_keys":    l.keyCount(),
+		"max_keys":      l.opts.maxKeys,
+		"lru_evictions": lruEvictions,
+		"ttl_evictions": ttlEvictions,
+		"capacity":      policy.Capacity,
+		"refill_rate":   policy.RefillRate,
+		"interval_ms":   policy.Interval.Milliseconds(),
+		"algorithm":     l.opts.algorithm.String(),
+		"refill_mode":   l.opts.refillMode.String(),
+		"store_errors":  l.storeErrors.Load(),
 	}
 }
 
-// Reset clears all rate limit buckets for the given key
+// Reset clears all rate limit buckets for the given key, including its
+// state in the Store if one is set
 func (l *Limiter) Reset(key string) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	delete(l.buckets, key)
+	if l.opts.store != nil {
+		if err := l.opts.store.Reset(context.Background(), l.opts.storePrefix+key); err != nil {
+			l.storeErrors.Add(1)
+		}
+	}
+	l.shardFor(key).delete(key)
 }
 
 // ResetAll clears all rate limit buckets
 func (l *Limiter) ResetAll() {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	l.buckets = make(map[string]*TokenBucket)
+	for _, s := range l.shards {
+		s.reset()
+	}
 }
@@ -1,7 +1,10 @@
 package ratelimit
 
 import (
+	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -107,6 +110,148 @@ func TestLimiterResetAll(t *testing.T) {
 	}
 }
 
+func TestLimiterCleanup(t *testing.T) {
+	clock := newTestClock()
+	// Inline cleanup sweeps the shard a new key lands in; use one shard so it sees every key
+	limiter := NewLimiter(2, 2, time.Minute, WithClock(clock), WithShards(1))
+
+	limiter.Allow("idle")
+	limiter.AllowN("busy", 2)
+
+	// Past the cleanup interval both buckets have refilled; the next new key
+	// triggers cleanup of every full bucket
+	clock.Advance(6 * time.Minute)
+	limiter.Allow("new")
+
+	if keys := limiter.Stats()["total_keys"]; keys != 1 {
+		t.Errorf("Expected only the new key after cleanup, got %v keys", keys)
+	}
+}
+
+func TestLimiterJanitor(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(2, 2, time.Second, WithClock(clock), WithJanitor(time.Minute))
+	defer limiter.Stop()
+
+	limiter.Allow("idle")
+	limiter.AllowN("busy", 2)
+
+	// Wait for the janitor to park, then let it run one sweep
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+
+	if keys := limiter.Stats()["total_keys"]; keys != 0 {
+		t.Errorf("Expected the janitor to remove refilled buckets, got %v keys", keys)
+	}
+}
+
+func TestLimiterJanitorKeepsActiveKeys(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(2, 2, time.Hour, WithClock(clock), WithJanitor(time.Minute))
+	defer limiter.Stop()
+
+	limiter.Allow("active")
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+
+	if keys := limiter.Stats()["total_keys"]; keys != 1 {
+		t.Errorf("Expected the partially used bucket to be kept, got %v keys", keys)
+	}
+}
+
+func TestLimiterStop(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(2, 2, time.Second, WithClock(clock), WithJanitor(time.Minute))
+
+	clock.BlockUntil(1)
+	limiter.Stop()
+	limiter.Stop() // safe to call twice
+
+	// Without a janitor Stop is a no-op
+	NewLimiter(1, 1, time.Second).Stop()
+}
+
+func TestLimiterMaxKeysEvictsLeastRecentlyUsed(t *testing.T) {
+	limiter := NewLimiter(2, 2, time.Minute, WithShards(1), WithMaxKeys(3))
+
+	limiter.Allow("a")
+	limiter.Allow("b")
+	limiter.Allow("c")
+
+	// Touch a so that b becomes the least recently used
+	limiter.Allow("a")
+	limiter.Allow("d")
+
+	stats := limiter.Stats()
+	if stats["total_keys"] != 3 {
+		t.Errorf("Expected 3 keys, got %v", stats["total_keys"])
+	}
+	if stats["lru_evictions"] != uint64(1) {
+		t.Errorf("Expected 1 LRU eviction, got %v", stats["lru_evictions"])
+	}
+
+	// a kept its state (both tokens used); b was evicted and starts fresh
+	if limiter.Allow("a") {
+		t.Error("Expected a to keep its state")
+	}
+	if !limiter.AllowN("b", 2) {
+		t.Error("Expected b to have been evicted")
+	}
+}
+
+func TestLimiterMaxKeysUnderFlood(t *testing.T) {
+	limiter := NewLimiter(10, 10, time.Minute, WithMaxKeys(1000))
+
+	for i := 0; i < 50000; i++ {
+		limiter.Allow(fmt.Sprintf("spoofed-%d", i))
+	}
+
+	// Each of the 32 shards holds at most ceil(1000/32) = 32 keys
+	if keys := limiter.Stats()["total_keys"].(int); keys > 1024 {
+		t.Errorf("Expected at most 1024 keys, got %d", keys)
+	}
+}
+
+func TestLimiterIdleTTL(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(10, 10, time.Hour, WithClock(clock), WithShards(1), WithIdleTTL(time.Minute))
+
+	limiter.Allow("idle")
+
+	// The bucket won't refill for an hour, but the key is idle past its TTL
+	clock.Advance(6 * time.Minute)
+	limiter.Allow("new")
+
+	stats := limiter.Stats()
+	if stats["total_keys"] != 1 {
+		t.Errorf("Expected the idle key to be removed, got %v keys", stats["total_keys"])
+	}
+	if stats["ttl_evictions"] != uint64(1) {
+		t.Errorf("Expected 1 TTL eviction, got %v", stats["ttl_evictions"])
+	}
+}
+
+func TestLimiterShards(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute, WithShards(4))
+
+	for i := 0; i < 100; i++ {
+		limiter.Allow(fmt.Sprintf("key-%d", i))
+	}
+
+	if keys := limiter.Stats()["total_keys"]; keys != 100 {
+		t.Errorf("Expected 100 keys across shards, got %v", keys)
+	}
+
+	for i := 0; i < 100; i++ {
+		if limiter.Allow(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("Expected key-%d to be limited in its shard", i)
+		}
+	}
+}
+
 func TestLimiterConcurrency(t *testing.T) {
 	limiter := NewLimiter(100, 100, time.Minute)
 	var wg sync.WaitGroup
@@ -178,3 +323,88 @@ func BenchmarkLimiterConcurrent(b *testing.B) {
 		}
 	})
 }
+
+func TestLimiterAlgorithms(t *testing.T) {
+	algorithms := []Algorithm{
+		TokenBucketAlgorithm,
+		SlidingWindowLogAlgorithm,
+		SlidingWindowCounterAlgorithm,
+		GCRAAlgorithm,
+		AtomicTokenBucketAlgorithm,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			var limiter RateLimiter = NewLimiter(3, 3, time.Minute, WithAlgorithm(algorithm))
+
+			for i := 0; i < 3; i++ {
+				if !limiter.Allow("key1") {
+					t.Errorf("Request %d should be allowed", i+1)
+				}
+			}
+
+			if limiter.Allow("key1") {
+				t.Error("Request 4 should be denied")
+			}
+
+			if !limiter.Allow("key2") {
+				t.Error("Different key should have a separate limit")
+			}
+
+			limiter.Reset("key1")
+			if !limiter.Allow("key1") {
+				t.Error("Request should be allowed after reset")
+			}
+
+			if limiter.Stats()["algorithm"] != algorithm.String() {
+				t.Errorf("Expected algorithm %s in stats, got %v", algorithm, limiter.Stats()["algorithm"])
+			}
+		})
+	}
+}
+
+// benchmarkKeys simulates gateway traffic from many distinct clients
+var benchmarkKeys = func() []string {
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+	return keys
+}()
+
+// BenchmarkLimiterConcurrentManyKeys compares a single lock (shards=1) with
+// the sharded store when many goroutines hit many distinct keys
+func BenchmarkLimiterConcurrentManyKeys(b *testing.B) {
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			limiter := NewLimiter(100, 100, time.Minute, WithShards(shards))
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					limiter.Allow(benchmarkKeys[i%len(benchmarkKeys)])
+					i += 7919
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkLimiterConcurrentNewKeys measures the slow path where every
+// request creates a key, which takes a write lock on the key's shard
+func BenchmarkLimiterConcurrentNewKeys(b *testing.B) {
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			limiter := NewLimiter(100, 100, time.Minute, WithShards(shards))
+			var next atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					limiter.Allow(strconv.FormatInt(next.Add(1), 10))
+				}
+			})
+		})
+	}
+}
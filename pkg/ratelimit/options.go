@@ -0,0 +1,214 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Algorithm selects the rate limiting algorithm a Limiter uses for each key
+type Algorithm int
+
+const (
+	// TokenBucketAlgorithm allows bursts up to capacity and refills at a fixed rate
+	TokenBucketAlgorithm Algorithm = iota
+
+	// SlidingWindowLogAlgorithm records every admitted request and enforces
+	// an exact limit over a rolling window
+	SlidingWindowLogAlgorithm
+
+	// SlidingWindowCounterAlgorithm approximates a rolling window by weighting
+	// the previous fixed window's count, using constant memory per key
+	SlidingWindowCounterAlgorithm
+
+	// GCRAAlgorithm implements the generic cell rate algorithm, which spaces
+	// requests evenly and tolerates bursts up to capacity
+	GCRAAlgorithm
+
+	// AtomicTokenBucketAlgorithm is a token bucket with continuous refill
+	// that uses compare-and-swap instead of a mutex, for heavily contended keys
+	AtomicTokenBucketAlgorithm
+)
+
+// String returns the name of the algorithm
+func (a Algorithm) String() string {
+	switch a {
+	case TokenBucketAlgorithm:
+		return "token_bucket"
+	case SlidingWindowLogAlgorithm:
+		return "sliding_window_log"
+	case SlidingWindowCounterAlgorithm:
+		return "sliding_window_counter"
+	case GCRAAlgorithm:
+		return "gcra"
+	case AtomicTokenBucketAlgorithm:
+		return "atomic_token_bucket"
+	default:
+		return fmt.Sprintf("algorithm(%d)", int(a))
+	}
+}
+
+// RefillMode controls how a TokenBucket earns tokens over time
+type RefillMode int
+
+const (
+	// RefillStepwise adds refillRate tokens at once each time a full interval has passed
+	RefillStepwise RefillMode = iota
+
+	// RefillContinuous adds tokens in proportion to elapsed time, so a drained
+	// bucket recovers one token every interval/refillRate
+	RefillContinuous
+)
+
+// String returns the name of the refill mode
+func (m RefillMode) String() string {
+	switch m {
+	case RefillStepwise:
+		return "stepwise"
+	case RefillContinuous:
+		return "continuous"
+	default:
+		return fmt.Sprintf("refill_mode(%d)", int(m))
+	}
+}
+
+// Option configures a Limiter or TokenBucket
+type Option func(*options)
+
+// options holds the settings shared by the limiter constructors
+type options struct {
+	algorithm  Algorithm
+	refillMode RefillMode
+	clock      Clock
+	location   *time.Location
+
+	shards          int
+	janitorInterval time.Duration
+	maxKeys         int
+	idleTTL         time.Duration
+	resolver        PolicyResolver
+
+	checkpointPath     string
+	checkpointInterval time.Duration
+	checkpointErr      func(error)
+
+	store       Store
+	storePrefix string
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		algorithm:  TokenBucketAlgorithm,
+		refillMode: RefillStepwise,
+		clock:      realClock{},
+		location:   time.UTC,
+		shards:     defaultShards,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithAlgorithm selects the per-key rate limiting algorithm (defaults to token bucket)
+func WithAlgorithm(a Algorithm) Option {
+	return func(o *options) {
+		o.algorithm = a
+	}
+}
+
+// WithRefillMode selects how token buckets refill (defaults to RefillStepwise)
+func WithRefillMode(m RefillMode) Option {
+	return func(o *options) {
+		o.refillMode = m
+	}
+}
+
+// WithClock sets the clock used to measure refills and windows (defaults to the system clock)
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithShards sets how many independently locked shards a Limiter spreads its keys across
+func WithShards(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.shards = n
+		}
+	}
+}
+
+// WithJanitor removes idle keys from a background goroutine every interval,
+// instead of cleaning up inline while a request that adds a key waits.
+// Call Limiter.Stop to stop the janitor.
+func WithJanitor(interval time.Duration) Option {
+	return func(o *options) {
+		o.janitorInterval = interval
+	}
+}
+
+// WithMaxKeys bounds how many keys a Limiter tracks. When a new key would
+// exceed the bound, the least recently used key in its shard is evicted, so
+// clients spoofing keys can't grow memory without limit. The bound is
+// spread evenly across shards.
+func WithMaxKeys(n int) Option {
+	return func(o *options) {
+		o.maxKeys = n
+	}
+}
+
+// WithIdleTTL removes keys that haven't been seen for ttl during cleanup,
+// even if their bucket hasn't refilled yet
+func WithIdleTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.idleTTL = ttl
+	}
+}
+
+// WithPolicyResolver sets a resolver the Limiter consults when it creates a
+// key's bucket, so keys can have their own limits (e.g., per billing plan)
+func WithPolicyResolver(r PolicyResolver) Option {
+	return func(o *options) {
+		o.resolver = r
+	}
+}
+
+// WithCheckpoint saves a snapshot of the Limiter to path every interval and
+// once more when Limiter.Stop is called, so state survives restarts. Load it
+// on startup with Limiter.LoadFile. Failed saves are passed to onError,
+// which may be nil.
+func WithCheckpoint(path string, interval time.Duration, onError func(error)) Option {
+	return func(o *options) {
+		o.checkpointPath = path
+		o.checkpointInterval = interval
+		o.checkpointErr = onError
+	}
+}
+
+// WithStore keeps the Limiter's state in a Store shared with other Limiters,
+// so that replicas enforce one limit between them. Keys are limited by the
+// store's continuously refilling token bucket whatever the algorithm, and
+// the Limiter falls back to its own buckets while the store is failing.
+func WithStore(s Store) Option {
+	return func(o *options) {
+		o.store = s
+	}
+}
+
+// WithStorePrefix prefixes the Limiter's keys in its Store, so Limiters that
+// share a store keep separate limits for the same key
+func WithStorePrefix(prefix string) Option {
+	return func(o *options) {
+		o.storePrefix = prefix
+	}
+}
+
+// WithLocation sets the time zone a Quota's calendar periods follow (defaults to UTC)
+func WithLocation(loc *time.Location) Option {
+	return func(o *options) {
+		if loc != nil {
+			o.location = loc
+		}
+	}
+}
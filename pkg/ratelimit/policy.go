@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy describes the limits applied to a key, such as a billing plan
+type Policy struct {
+	// Name identifies the policy (e.g., "free", "pro") in stats and lookups
+	Name string `json:"name,omitempty"`
+
+	// Capacity is the maximum burst, or the limit per window for the window algorithms
+	Capacity int64 `json:"capacity"`
+
+	// RefillRate is the number of tokens added per Interval
+	RefillRate int64 `json:"refill_rate"`
+
+	// Interval is the period RefillRate is measured over
+	Interval time.Duration `json:"interval"`
+}
+
+// PolicyResolver returns the policy for a key. Returning false applies the
+// limiter's default policy.
+type PolicyResolver func(key string) (Policy, bool)
+
+// withDefaults fills zero fields from the default policy
+func (p Policy) withDefaults(def Policy) Policy {
+	if p.Capacity == 0 {
+		p.Capacity = def.Capacity
+	}
+	if p.RefillRate == 0 {
+		p.RefillRate = def.RefillRate
+	}
+	if p.Interval == 0 {
+		p.Interval = def.Interval
+	}
+	return p
+}
+
+// validate returns an error if p's limits can't make a bucket
+func (p Policy) validate() error {
+	switch {
+	case p.Capacity <= 0:
+		return fmt.Errorf("capacity %d is not positive", p.Capacity)
+	case p.RefillRate < 0:
+		return fmt.Errorf("refill rate %d is negative", p.RefillRate)
+	case p.Interval <= 0:
+		return fmt.Errorf("interval %v is not positive", p.Interval)
+	}
+	return nil
+}
+
+// Window returns the time it takes to refill Capacity tokens at RefillRate
+// per Interval, which is the rolling window used by the window algorithms
+func (p Policy) Window() time.Duration {
+	if p.RefillRate <= 0 || p.RefillRate == p.Capacity {
+		return p.Interval
+	}
+	return time.Duration(float64(p.Interval) * float64(p.Capacity) / float64(p.RefillRate))
+}
+
+// carry returns the used requests a key keeps when its capacity changes
+// from oldCapacity to newCapacity: the same share of it with rescale, or
+// else the same number, up to newCapacity
+func carry(used, oldCapacity, newCapacity int64, rescale bool) int64 {
+	if rescale {
+		return scale(used, oldCapacity, newCapacity)
+	}
+	return min(used, newCapacity)
+}
+
+// carryShare is carry for a fractional number of used requests, as the
+// GCRA and atomic token bucket measure them
+func carryShare(used float64, oldCapacity, newCapacity int64, rescale bool) float64 {
+	if rescale {
+		if oldCapacity <= 0 {
+			return used
+		}
+		return used * float64(newCapacity) / float64(oldCapacity)
+	}
+	return min(used, float64(newCapacity))
+}
+
+// scale returns used rescaled from oldCapacity to newCapacity, so a key
+// keeps the same fraction of its allowance when its limits change
+func scale(used, oldCapacity, newCapacity int64) int64 {
+	if oldCapacity <= 0 || oldCapacity == newCapacity {
+		return used
+	}
+	return int64(float64(used) * float64(newCapacity) / float64(oldCapacity))
+}
@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	freePlan = Policy{Name: "free", Capacity: 10, RefillRate: 10, Interval: time.Minute}
+	proPlan  = Policy{Name: "pro", Capacity: 100, RefillRate: 100, Interval: time.Minute}
+)
+
+// planByPrefix resolves keys like "pro:alice" to the matching plan
+func planByPrefix(key string) (Policy, bool) {
+	switch {
+	case strings.HasPrefix(key, "pro:"):
+		return proPlan, true
+	case strings.HasPrefix(key, "free:"):
+		return freePlan, true
+	}
+	return Policy{}, false
+}
+
+func TestLimiterPolicyResolver(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute, WithPolicyResolver(planByPrefix))
+
+	if !limiter.AllowN("free:bob", 10) || limiter.Allow("free:bob") {
+		t.Error("Expected free plan to allow exactly 10 requests")
+	}
+
+	if !limiter.AllowN("pro:alice", 100) || limiter.Allow("pro:alice") {
+		t.Error("Expected pro plan to allow exactly 100 requests")
+	}
+
+	// Keys the resolver doesn't know get the default policy
+	if !limiter.Allow("anonymous") || limiter.Allow("anonymous") {
+		t.Error("Expected default policy to allow exactly 1 request")
+	}
+
+	if name := limiter.Policy("pro:alice").Name; name != "pro" {
+		t.Errorf("Expected pro policy, got %q", name)
+	}
+}
+
+func TestLimiterSetPolicyKeepsUsage(t *testing.T) {
+	algorithms := []Algorithm{
+		TokenBucketAlgorithm,
+		SlidingWindowLogAlgorithm,
+		SlidingWindowCounterAlgorithm,
+		GCRAAlgorithm,
+		AtomicTokenBucketAlgorithm,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			clock := newTestClock()
+			limiter := NewLimiter(10, 10, time.Minute, WithAlgorithm(algorithm), WithClock(clock))
+
+			// Use most of the free allowance, then upgrade
+			limiter.AllowN("customer", 8)
+			limiter.SetPolicy("customer", proPlan)
+
+			if info, _ := limiter.Inspect("customer"); info.Remaining != 92 {
+				t.Errorf("Expected the 8 used requests to carry over, got %d remaining", info.Remaining)
+			}
+			if !limiter.AllowN("customer", 92) || limiter.Allow("customer") {
+				t.Error("Expected exactly 92 requests left after the upgrade")
+			}
+
+			// Downgrading can't leave more used than the new capacity
+			limiter.SetPolicy("customer", freePlan)
+			if info, _ := limiter.Inspect("customer"); info.Remaining != 0 {
+				t.Errorf("Expected the free allowance to be used up, got %d remaining", info.Remaining)
+			}
+			clock.Advance(2 * time.Minute)
+			if !limiter.Allow("customer") {
+				t.Error("Expected requests to refill after the downgrade")
+			}
+		})
+	}
+}
+
+func TestLimiterSetPolicyPersists(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute)
+
+	// Zero fields come from the default policy
+	limiter.SetPolicy("customer", Policy{Name: "custom", Capacity: 3})
+	limiter.Reset("customer")
+
+	if !limiter.AllowN("customer", 3) || limiter.Allow("customer") {
+		t.Error("Expected the policy to apply to the recreated bucket")
+	}
+
+	p := limiter.Policy("customer")
+	if p.RefillRate != 1 || p.Interval != time.Minute {
+		t.Errorf("Expected default refill settings, got %+v", p)
+	}
+
+	limiter.ClearPolicy("customer")
+	limiter.Reset("customer")
+
+	if !limiter.Allow("customer") || limiter.Allow("customer") {
+		t.Error("Expected the default policy after ClearPolicy")
+	}
+}
+
+func TestLimiterUpdate(t *testing.T) {
+	algorithms := []Algorithm{
+		TokenBucketAlgorithm,
+		SlidingWindowLogAlgorithm,
+		SlidingWindowCounterAlgorithm,
+		GCRAAlgorithm,
+		AtomicTokenBucketAlgorithm,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			clock := newTestClock()
+			limiter := NewLimiter(10, 10, time.Minute, WithClock(clock), WithAlgorithm(algorithm))
+			limiter.AllowN("half", 5)
+
+			limiter.Update(20, 20, 0)
+
+			// The existing key keeps half its allowance of the new limit
+			if !limiter.AllowN("half", 10) || limiter.Allow("half") {
+				t.Error("Expected 10 of 20 remaining after the update")
+			}
+			if !limiter.AllowN("new", 20) {
+				t.Error("Expected a new key to get the updated capacity")
+			}
+
+			if p := limiter.Policy("half"); p.Capacity != 20 || p.Interval != time.Minute {
+				t.Errorf("Expected the updated policy with the interval kept, got %+v", p)
+			}
+			if capacity := limiter.Stats()["capacity"]; capacity != int64(20) {
+				t.Errorf("Expected stats to report the new capacity, got %v", capacity)
+			}
+		})
+	}
+}
+
+func TestLimiterUpdateKeepsOwnPolicies(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute, WithPolicyResolver(planByPrefix))
+	limiter.Allow("pro:alice")
+	limiter.Allow("anonymous")
+
+	limiter.Update(5, 5, time.Minute)
+
+	if p := limiter.Policy("pro:alice"); p != proPlan {
+		t.Errorf("Expected the pro plan to be kept, got %+v", p)
+	}
+	if p := limiter.Policy("anonymous"); p.Capacity != 5 {
+		t.Errorf("Expected the default key to be updated, got %+v", p)
+	}
+}
+
+func TestLimiterUpdateFillsSetPolicy(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute)
+	limiter.SetPolicy("k", Policy{Name: "custom", RefillRate: 7})
+	limiter.Allow("k")
+
+	limiter.Update(50, 0, 0)
+
+	want := Policy{Name: "custom", Capacity: 50, RefillRate: 7, Interval: time.Minute}
+	if p := limiter.Policy("k"); p != want {
+		t.Errorf("Expected the override to take the updated capacity, got %+v", p)
+	}
+	if info, _ := limiter.Inspect("k"); info.Capacity != 50 {
+		t.Errorf("Expected the existing bucket to be reconfigured, got capacity %d", info.Capacity)
+	}
+}
+
+func TestLimiterUpdateConcurrent(t *testing.T) {
+	limiter := NewLimiter(100, 100, time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int64(1); i <= 50; i++ {
+			limiter.Update(100+i, 100+i, 0)
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		limiter.Allow(string(rune('a' + i%26)))
+	}
+	<-done
+
+	for _, key := range []string{"a", "m", "z"} {
+		if p := limiter.Policy(key); p.Capacity != 150 {
+			t.Errorf("Expected %s to end on the last update, got %+v", key, p)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QuotaPeriod is the calendar period a Quota resets on
+type QuotaPeriod int
+
+const (
+	// QuotaHourly resets at the start of every hour
+	QuotaHourly QuotaPeriod = iota
+
+	// QuotaDaily resets at midnight
+	QuotaDaily
+
+	// QuotaMonthly resets at midnight on the first of the month
+	QuotaMonthly
+)
+
+// String returns the name of the period
+func (p QuotaPeriod) String() string {
+	switch p {
+	case QuotaHourly:
+		return "hourly"
+	case QuotaDaily:
+		return "daily"
+	case QuotaMonthly:
+		return "monthly"
+	default:
+		return fmt.Sprintf("quota_period(%d)", int(p))
+	}
+}
+
+// bounds returns the start and end of the period containing now in loc
+func (p QuotaPeriod) bounds(now time.Time, loc *time.Location) (start, end time.Time) {
+	t := now.In(loc)
+	switch p {
+	case QuotaHourly:
+		// Truncate within the hour rather than rebuilding the date, so the
+		// hour repeated when clocks go back isn't mistaken for the first one
+		start = t.Add(-time.Duration(t.Minute())*time.Minute -
+			time.Duration(t.Second())*time.Second -
+			time.Duration(t.Nanosecond()))
+		return start, start.Add(time.Hour)
+	case QuotaMonthly:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// QuotaUsage reports a key's use of its quota in the current period
+type QuotaUsage struct {
+	Limit     int64
+	Used      int64
+	Remaining int64
+	Period    QuotaPeriod
+
+	// ResetAt is when the current period ends and the quota starts over
+	ResetAt time.Time
+}
+
+// Quota limits how many requests each key makes per calendar period, such
+// as a monthly API quota that resets at midnight UTC on the 1st. Unlike a
+// token bucket, unused requests don't carry over and nothing refills
+// during the period. Combine it with a burst limiter in a Composite, with
+// the quota last so requests the burst limiter rejects aren't counted.
+// Safe for concurrent use by multiple goroutines
+type Quota struct {
+	limit    int64
+	period   QuotaPeriod
+	location *time.Location
+	resolver PolicyResolver
+	start    time.Time        // Start of the current period
+	end      time.Time        // End of the current period
+	used     map[string]int64 // Requests per key in the current period
+	clock    Clock
+	mu       sync.Mutex
+}
+
+// NewQuota creates a quota of limit requests per key each period. Periods
+// follow the calendar in UTC unless WithLocation is given. With
+// WithPolicyResolver, a resolved policy's Capacity is the key's limit.
+func NewQuota(limit int64, period QuotaPeriod, opts ...Option) *Quota {
+	o := newOptions(opts)
+	q := &Quota{
+		limit:    limit,
+		period:   period,
+		location: o.location,
+		resolver: o.resolver,
+		used:     make(map[string]int64),
+		clock:    o.clock,
+	}
+	q.start, q.end = period.bounds(o.clock.Now(), q.location)
+	return q
+}
+
+// Allow checks if a request for the given key fits in its quota and counts it if so
+func (q *Quota) Allow(key string) bool {
+	return q.AllowN(key, 1)
+}
+
+// AllowN checks if n requests for the given key fit in its quota and counts them if so
+func (q *Quota) AllowN(key string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.clock.Now())
+
+	used := q.used[key]
+	if used+n > q.limitFor(key) {
+		return false
+	}
+
+	q.used[key] = used + n
+	return true
+}
+
+// Refund gives back n requests counted for the given key in the current period
+func (q *Quota) Refund(key string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.clock.Now())
+
+	if used := q.used[key] - n; used > 0 {
+		q.used[key] = used
+	} else {
+		delete(q.used, key)
+	}
+}
+
+// Usage returns the key's use of its quota in the current period
+func (q *Quota) Usage(key string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.clock.Now())
+
+	limit := q.limitFor(key)
+	used := q.used[key]
+	return QuotaUsage{
+		Limit:     limit,
+		Used:      used,
+		Remaining: max(limit-used, 0),
+		Period:    q.period,
+		ResetAt:   q.end,
+	}
+}
+
+// rollover starts a new period once the current one has ended. Every key
+// shares the calendar, so the old period's counts can all be dropped.
+// Must be called with lock held
+func (q *Quota) rollover(now time.Time) {
+	if now.Before(q.end) {
+		return
+	}
+
+	q.start, q.end = q.period.bounds(now, q.location)
+	q.used = make(map[string]int64)
+}
+
+// limitFor returns the key's limit per period
+// Must be called with lock held
+func (q *Quota) limitFor(key string) int64 {
+	if q.resolver != nil {
+		if p, ok := q.resolver(key); ok && p.Capacity > 0 {
+			return p.Capacity
+		}
+	}
+	return q.limit
+}
+
+// Reset clears the key's usage in the current period
+func (q *Quota) Reset(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.used, key)
+}
+
+// Stats returns statistics about the quota
+func (q *Quota) Stats() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.clock.Now())
+
+	return map[string]interface{}{
+		"total_keys":   len(q.used),
+		"capacity":     q.limit,
+		"period":       q.period.String(),
+		"location":     q.location.String(),
+		"period_start": q.start,
+		"reset_at":     q.end,
+	}
+}
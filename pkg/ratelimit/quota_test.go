@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit/ratelimittest"
+)
+
+func TestQuotaDailyResetsAtMidnight(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Date(2024, 3, 14, 23, 0, 0, 0, time.UTC))
+	quota := NewQuota(2, QuotaDaily, WithClock(clock))
+
+	if !quota.AllowN("key", 2) || quota.Allow("key") {
+		t.Fatal("Expected exactly 2 requests per day")
+	}
+
+	usage := quota.Usage("key")
+	if usage.Used != 2 || usage.Remaining != 0 {
+		t.Errorf("Expected 2 used and 0 remaining, got %+v", usage)
+	}
+	if want := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC); !usage.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at %v, got %v", want, usage.ResetAt)
+	}
+
+	// Nothing refills during the day
+	clock.Advance(59 * time.Minute)
+	if quota.Allow("key") {
+		t.Error("Expected the quota to stay spent until midnight")
+	}
+
+	clock.Advance(time.Minute)
+	if !quota.Allow("key") {
+		t.Error("Expected the quota to reset at midnight")
+	}
+}
+
+func TestQuotaMonthlyFollowsLocation(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data unavailable: %v", err)
+	}
+
+	clock := ratelimittest.NewClock(time.Date(2024, 2, 29, 12, 0, 0, 0, loc))
+	quota := NewQuota(100, QuotaMonthly, WithClock(clock), WithLocation(loc))
+	quota.AllowN("key", 100)
+
+	want := time.Date(2024, 3, 1, 0, 0, 0, 0, loc)
+	if usage := quota.Usage("key"); !usage.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at local midnight on the 1st (%v), got %v", want, usage.ResetAt)
+	}
+
+	// Midnight UTC on the 1st is still February in New York
+	clock.Set(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	if quota.Allow("key") {
+		t.Error("Expected the quota to follow the local calendar")
+	}
+
+	clock.Set(want)
+	if !quota.Allow("key") {
+		t.Error("Expected the quota to reset on the 1st in New York")
+	}
+}
+
+func TestQuotaHourlyAcrossDSTFallBack(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data unavailable: %v", err)
+	}
+
+	// 01:30 EDT; clocks go back at 02:00 EDT to 01:00 EST
+	first := time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC)
+	clock := ratelimittest.NewClock(first)
+	quota := NewQuota(1, QuotaHourly, WithClock(clock), WithLocation(loc))
+	quota.Allow("key")
+
+	// 01:30 EST, the repeated hour, is a new period
+	clock.Advance(time.Hour)
+	if !quota.Allow("key") {
+		t.Error("Expected the repeated hour to be a new period")
+	}
+	if usage := quota.Usage("key"); !usage.ResetAt.Equal(first.Add(90 * time.Minute)) {
+		t.Errorf("Expected reset an hour after the repeated hour began, got %v", usage.ResetAt)
+	}
+}
+
+func TestQuotaPerKeyLimits(t *testing.T) {
+	quota := NewQuota(10, QuotaMonthly, WithPolicyResolver(planByPrefix))
+
+	if usage := quota.Usage("pro:alice"); usage.Limit != 100 {
+		t.Errorf("Expected the pro plan's capacity as the limit, got %d", usage.Limit)
+	}
+	if usage := quota.Usage("anonymous"); usage.Limit != 10 {
+		t.Errorf("Expected the default limit, got %d", usage.Limit)
+	}
+}
+
+func TestQuotaWithBurstLimiter(t *testing.T) {
+	clock := newTestClock()
+	burst := NewLimiter(2, 2, time.Second, WithClock(clock))
+	quota := NewQuota(3, QuotaDaily, WithClock(clock))
+
+	limiter := NewComposite(
+		Level{Name: "burst", Limiter: burst},
+		Level{Name: "quota", Limiter: quota},
+	)
+
+	limiter.Allow("key")
+	limiter.Allow("key")
+	if limiter.Allow("key") {
+		t.Error("Expected the burst limiter to reject the third request")
+	}
+	if used := quota.Usage("key").Used; used != 2 {
+		t.Errorf("Expected rejected requests not to count towards the quota, got %d used", used)
+	}
+
+	clock.Advance(time.Second)
+	if !limiter.Allow("key") || limiter.Allow("key") {
+		t.Error("Expected the quota to allow one more request after the burst refills")
+	}
+	if burst.Allow("key") != true {
+		t.Error("Expected the quota's rejection to refund the burst limiter")
+	}
+}
@@ -0,0 +1,109 @@
+// Package ratelimittest provides helpers for testing code that uses the
+// ratelimit package without sleeping.
+package ratelimittest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a manually advanced clock that satisfies ratelimit.Clock.
+// Time only moves when Advance or Set is called, and channels returned by
+// After fire once the clock reaches their deadline.
+// Safe for concurrent use by multiple goroutines
+type Clock struct {
+	now     time.Time
+	waiters []waiter
+	mu      sync.Mutex
+	cond    *sync.Cond
+}
+
+// waiter is a pending After call
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewClock creates a fake clock set to start
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the fake current time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// After returns a channel that receives the fake time once the clock has
+// been advanced by at least d
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, waiter{deadline: c.now.Add(d), ch: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward by d and fires any expired After channels
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to t and fires any expired After channels
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(t)
+}
+
+// set updates the time and notifies expired waiters
+// Must be called with lock held
+func (c *Clock) set(t time.Time) {
+	c.now = t
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(t) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- t
+	}
+	c.waiters = pending
+	c.cond.Broadcast()
+}
+
+// Waiters returns the number of After channels that have not fired yet
+func (c *Clock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n After channels are waiting to fire.
+// Use it to make sure a goroutine is parked in Wait before advancing time.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
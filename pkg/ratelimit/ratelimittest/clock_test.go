@@ -0,0 +1,66 @@
+package ratelimittest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit"
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit/ratelimittest"
+)
+
+var _ ratelimit.Clock = (*ratelimittest.Clock)(nil)
+
+func TestClockAdvance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := ratelimittest.NewClock(start)
+
+	clock.Advance(time.Minute)
+	if got := clock.Now(); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("Expected %v, got %v", start.Add(time.Minute), got)
+	}
+}
+
+func TestClockAfter(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Unix(0, 0))
+
+	ch := clock.After(time.Second)
+	if clock.Waiters() != 1 {
+		t.Errorf("Expected 1 waiter, got %d", clock.Waiters())
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatal("After fired before its deadline")
+	default:
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("After did not fire at its deadline")
+	}
+
+	if clock.Waiters() != 0 {
+		t.Errorf("Expected 0 waiters, got %d", clock.Waiters())
+	}
+}
+
+func TestClockBlockUntil(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Unix(0, 0))
+	limiter := ratelimit.NewLimiter(1, 1, time.Second, ratelimit.WithClock(clock))
+	limiter.Allow("key")
+
+	done := make(chan error)
+	go func() {
+		done <- limiter.Wait(t.Context(), "key")
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	if err := <-done; err != nil {
+		t.Errorf("Wait failed: %v", err)
+	}
+}
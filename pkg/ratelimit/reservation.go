@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrExceedsCapacity is returned when more tokens are requested than the limiter can ever hold
+	ErrExceedsCapacity = errors.New("ratelimit: n exceeds limiter capacity")
+
+	// ErrWouldExceedDeadline is returned when the wait for tokens would outlast the context deadline
+	ErrWouldExceedDeadline = fmt.Errorf("ratelimit: wait would exceed context deadline: %w", context.DeadlineExceeded)
+)
+
+// Reservation holds tokens taken ahead of time. The caller should wait
+// Delay() before acting, or call Cancel to give the tokens back.
+type Reservation struct {
+	ok        bool
+	tokens    int64
+	timeToAct time.Time
+	clock     Clock
+	cancel    func()
+	once      sync.Once
+}
+
+// OK reports whether the limiter can provide the requested tokens.
+// If OK is false, Delay returns InfDuration and Cancel does nothing.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Tokens returns the number of tokens held by the reservation
+func (r *Reservation) Tokens() int64 {
+	return r.tokens
+}
+
+// Delay returns how long the caller should wait before acting on the reservation
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return InfDuration
+	}
+	return r.DelayFrom(r.clock.Now())
+}
+
+// DelayFrom returns how long after now the caller should wait before acting
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	if !r.ok {
+		return InfDuration
+	}
+
+	delay := r.timeToAct.Sub(now)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Cancel returns the reserved tokens to the limiter.
+// Calling Cancel more than once has no further effect.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil {
+		return
+	}
+	r.once.Do(r.cancel)
+}
+
+// reserver is implemented by buckets that can hand out tokens in advance
+type reserver interface {
+	ReserveN(n int64) *Reservation
+}
+
+// waitReservation blocks until the reservation can be acted on or ctx is done.
+// The reservation is cancelled if the caller gives up waiting.
+func waitReservation(ctx context.Context, r *Reservation) error {
+	if !r.OK() {
+		return ErrExceedsCapacity
+	}
+
+	now := r.clock.Now()
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		r.Cancel()
+		return ErrWouldExceedDeadline
+	}
+
+	select {
+	case <-r.clock.After(delay):
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// waitPoll blocks until b admits n requests or ctx is done, for buckets that
+// cannot reserve tokens ahead of time. It sleeps until the bucket reports
+// capacity and retries, since another caller may take it first.
+func waitPoll(ctx context.Context, clock Clock, b bucket, n int64) error {
+	for {
+		if b.AllowN(n) {
+			return nil
+		}
+
+		delay := b.TimeUntil(n)
+		if delay == InfDuration {
+			return ErrExceedsCapacity
+		}
+		if delay <= 0 {
+			// Capacity was there but another caller took it first
+			delay = time.Millisecond
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(clock.Now().Add(delay)) {
+			return ErrWouldExceedDeadline
+		}
+
+		select {
+		case <-clock.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
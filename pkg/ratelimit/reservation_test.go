@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	tb := NewTokenBucket(2, 2, time.Minute)
+
+	r := tb.ReserveN(2)
+	if !r.OK() || r.Delay() != 0 {
+		t.Fatalf("Expected an immediate reservation, got ok=%v delay=%v", r.OK(), r.Delay())
+	}
+
+	r = tb.Reserve()
+	if !r.OK() {
+		t.Fatal("Expected reservation to be OK")
+	}
+	if r.Delay() <= 0 {
+		t.Error("Expected reservation beyond available tokens to have a delay")
+	}
+
+	// Owed tokens must be repaid before anything is available
+	if tb.Available() != 0 {
+		t.Errorf("Expected 0 available, got %d", tb.Available())
+	}
+
+	r.Cancel()
+	r.Cancel() // second cancel is a no-op
+	if tb.Available() != 0 {
+		t.Errorf("Expected cancel to repay the debt only, got %d available", tb.Available())
+	}
+}
+
+func TestTokenBucketReserveCancel(t *testing.T) {
+	tb := NewTokenBucket(5, 5, time.Minute)
+
+	r := tb.ReserveN(3)
+	if tb.Available() != 2 {
+		t.Errorf("Expected 2 available, got %d", tb.Available())
+	}
+
+	r.Cancel()
+	if tb.Available() != 5 {
+		t.Errorf("Expected tokens back after cancel, got %d", tb.Available())
+	}
+}
+
+func TestTokenBucketReserveExceedsCapacity(t *testing.T) {
+	tb := NewTokenBucket(5, 5, time.Minute)
+
+	r := tb.ReserveN(6)
+	if r.OK() {
+		t.Error("Expected reservation over capacity to fail")
+	}
+	if r.Delay() != InfDuration {
+		t.Errorf("Expected InfDuration, got %v", r.Delay())
+	}
+	r.Cancel()
+
+	if tb.Available() != 5 {
+		t.Errorf("Expected failed reservation to take nothing, got %d", tb.Available())
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	clock := newTestClock()
+	// One token every 10ms
+	tb := NewTokenBucket(1, 100, time.Second, WithRefillMode(RefillContinuous), WithClock(clock))
+	tb.Allow()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tb.Wait(context.Background())
+	}()
+
+	clock.BlockUntil(1)
+	select {
+	case <-done:
+		t.Fatal("Wait returned before the next token")
+	default:
+	}
+
+	clock.Advance(10 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+}
+
+func TestTokenBucketWaitDeadline(t *testing.T) {
+	tb := NewTokenBucket(1, 1, time.Minute)
+	tb.Allow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := tb.Wait(ctx)
+	if !errors.Is(err, ErrWouldExceedDeadline) {
+		t.Fatalf("Expected ErrWouldExceedDeadline, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected error to match context.DeadlineExceeded")
+	}
+
+	// The failed wait must not leave tokens owed
+	if wait := tb.TimeUntil(1); wait > time.Minute {
+		t.Errorf("Expected at most one interval to the next token, got %v", wait)
+	}
+}
+
+func TestTokenBucketWaitCancelled(t *testing.T) {
+	tb := NewTokenBucket(1, 1, time.Minute)
+	tb.Allow()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	if err := tb.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestTokenBucketWaitExceedsCapacity(t *testing.T) {
+	tb := NewTokenBucket(5, 5, time.Minute)
+
+	if err := tb.WaitN(context.Background(), 6); !errors.Is(err, ErrExceedsCapacity) {
+		t.Errorf("Expected ErrExceedsCapacity, got %v", err)
+	}
+}
+
+func TestGCRAReserve(t *testing.T) {
+	clock := newTestClock()
+	g := NewGCRA(1, 10, time.Second, WithClock(clock))
+
+	if r := g.Reserve(); !r.OK() || r.Delay() != 0 {
+		t.Fatal("Expected an immediate reservation")
+	}
+
+	r := g.Reserve()
+	if delay := r.Delay(); delay != 100*time.Millisecond {
+		t.Errorf("Expected to wait one emission interval, got %v", delay)
+	}
+
+	r.Cancel()
+	if wait := g.TimeUntil(1); wait != 100*time.Millisecond {
+		t.Errorf("Expected cancel to release the booked slot, got wait %v", wait)
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	algorithms := []Algorithm{
+		TokenBucketAlgorithm,
+		SlidingWindowLogAlgorithm,
+		SlidingWindowCounterAlgorithm,
+		GCRAAlgorithm,
+		AtomicTokenBucketAlgorithm,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			clock := newTestClock()
+			limiter := NewLimiter(2, 2, time.Second, WithAlgorithm(algorithm), WithClock(clock))
+			limiter.AllowN("key", 2)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- limiter.Wait(context.Background(), "key")
+			}()
+
+			clock.BlockUntil(1)
+			select {
+			case <-done:
+				t.Fatal("Wait returned before capacity was available")
+			default:
+			}
+
+			// Long enough for every algorithm, including the window counter's decay
+			clock.Advance(2 * time.Second)
+			if err := <-done; err != nil {
+				t.Fatalf("Wait failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestLimiterReserve(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute)
+
+	if r := limiter.Reserve("key"); !r.OK() || r.Delay() != 0 {
+		t.Error("Expected an immediate reservation")
+	}
+
+	windowLimiter := NewLimiter(1, 1, time.Minute, WithAlgorithm(SlidingWindowLogAlgorithm))
+	if windowLimiter.Reserve("key").OK() {
+		t.Error("Expected window algorithms not to support reservations")
+	}
+}
@@ -0,0 +1,235 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrStoreContention is returned when a key is updated by other clients so
+// often that a take can't complete within the configured retries
+var ErrStoreContention = errors.New("ratelimit: too much contention on store key")
+
+// RESPStoreConfig configures a RESPStore
+type RESPStoreConfig struct {
+	// Addr is the host:port of the Redis-compatible server
+	Addr string
+
+	// Password is sent with AUTH on each new connection when set
+	Password string
+
+	// KeyPrefix is prepended to every key (defaults to "ratelimit:")
+	KeyPrefix string
+
+	// PoolSize is the maximum number of idle connections kept open (defaults to 8)
+	PoolSize int
+
+	// Timeout bounds each call, including dialing (defaults to 500ms)
+	Timeout time.Duration
+
+	// MaxRetries is how many times a take is retried when another client
+	// updates the key at the same time (defaults to 16)
+	MaxRetries int
+}
+
+// RESPStore is a Store kept on a server speaking the Redis protocol (RESP),
+// such as Redis, Valkey or KeyDB. Takes are made atomic with WATCH and
+// MULTI/EXEC, so they need no server-side scripting. Keys expire once their
+// bucket is full again.
+// Safe for concurrent use by multiple goroutines
+type RESPStore struct {
+	config RESPStoreConfig
+	idle   chan *respConn
+}
+
+// respConn is a connection to the server with buffered I/O
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// NewRESPStore creates a store for the server at config.Addr.
+// Connections are opened as needed.
+func NewRESPStore(config RESPStoreConfig) *RESPStore {
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = "ratelimit:"
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = 8
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 500 * time.Millisecond
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 16
+	}
+
+	return &RESPStore{
+		config: config,
+		idle:   make(chan *respConn, config.PoolSize),
+	}
+}
+
+// Take refills key's bucket and takes n tokens if available
+func (s *RESPStore) Take(ctx context.Context, key string, n int64, p Policy, now time.Time) (TakeResult, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return TakeResult{}, err
+	}
+
+	result, err := s.take(c, s.config.KeyPrefix+key, n, p, now)
+	s.put(c, err)
+	return result, err
+}
+
+// take runs the optimistic WATCH/MULTI/EXEC loop for one key
+func (s *RESPStore) take(c *respConn, key string, n int64, p Policy, now time.Time) (TakeResult, error) {
+	for attempt := 0; attempt < s.config.MaxRetries; attempt++ {
+		if _, err := c.do("WATCH", key); err != nil {
+			return TakeResult{}, err
+		}
+
+		reply, err := c.do("GET", key)
+		if err != nil {
+			return TakeResult{}, err
+		}
+
+		var tat int64
+		if value, ok := reply.(string); ok {
+			if tat, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return TakeResult{}, fmt.Errorf("ratelimit: invalid state for key %s: %w", key, err)
+			}
+		}
+
+		newTat, result := takeTAT(tat, n, p, now)
+		if newTat == tat {
+			// Nothing to write, such as when the take was denied
+			_, err := c.do("UNWATCH")
+			return result, err
+		}
+
+		write := []string{"DEL", key}
+		if newTat != 0 {
+			ttl := (time.Duration(newTat-now.UnixNano()) + time.Millisecond - 1) / time.Millisecond
+			write = []string{"SET", key, strconv.FormatInt(newTat, 10), "PX", strconv.FormatInt(int64(ttl), 10)}
+		}
+
+		reply, err = c.transaction(write...)
+		if err != nil {
+			return TakeResult{}, err
+		}
+		if reply != nil {
+			return result, nil
+		}
+		// Another client changed the key since WATCH; try again
+	}
+
+	return TakeResult{}, ErrStoreContention
+}
+
+// Reset removes the state stored for key
+func (s *RESPStore) Reset(ctx context.Context, key string) error {
+	c, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do("DEL", s.config.KeyPrefix+key)
+	s.put(c, err)
+	return err
+}
+
+// Close closes the idle connections. Calls made after Close open new ones.
+func (s *RESPStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns an idle connection or dials a new one, with a deadline for the call
+func (s *RESPStore) get(ctx context.Context) (*respConn, error) {
+	deadline := time.Now().Add(s.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	select {
+	case c := <-s.idle:
+		if err := c.conn.SetDeadline(deadline); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", s.config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: connecting to store: %w", err)
+	}
+	conn.SetDeadline(deadline)
+
+	c := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if s.config.Password != "" {
+		if _, err := c.do("AUTH", s.config.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool, or closes it if the call failed
+// (possibly leaving a reply unread or a key watched) or the pool is full
+func (s *RESPStore) put(c *respConn, err error) {
+	if err != nil {
+		c.conn.Close()
+		return
+	}
+
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// do sends a command and reads its reply, turning error replies into errors
+func (c *respConn) do(args ...string) (interface{}, error) {
+	if err := writeRESPCommand(c.w, args...); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRESPReply(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := reply.(respError); ok {
+		return nil, replyErr
+	}
+	return reply, nil
+}
+
+// transaction runs a command in MULTI/EXEC. It returns nil without error if
+// a watched key changed and the transaction was discarded.
+func (c *respConn) transaction(args ...string) (interface{}, error) {
+	if _, err := c.do("MULTI"); err != nil {
+		return nil, err
+	}
+	if _, err := c.do(args...); err != nil {
+		c.do("DISCARD")
+		return nil, err
+	}
+	return c.do("EXEC")
+}
@@ -0,0 +1,316 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// respSimple is a simple string reply written by the test server
+type respSimple string
+
+// respValue is a value held by the test server
+type respValue struct {
+	value   string
+	expires time.Time
+}
+
+// respTestServer is a minimal in-process stand-in for a RESP server,
+// supporting the commands RESPStore uses
+type respTestServer struct {
+	ln       net.Listener
+	password string
+	values   map[string]respValue
+	versions map[string]uint64 // Bumped on every write, for WATCH
+	aborts   atomic.Int64      // Transactions discarded because a watched key changed
+	mu       sync.Mutex
+}
+
+func newRESPTestServer(t *testing.T, password string) *respTestServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	srv := &respTestServer{
+		ln:       ln,
+		password: password,
+		values:   make(map[string]respValue),
+		versions: make(map[string]uint64),
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *respTestServer) addr() string {
+	return srv.ln.Addr().String()
+}
+
+// serve handles one client connection
+func (srv *respTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := srv.password == ""
+	watched := make(map[string]uint64)
+	var queued [][]string
+	inMulti := false
+
+	for {
+		reply, err := readRESPReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		cmd := strings.ToUpper(args[0])
+		var out interface{}
+		switch {
+		case cmd == "AUTH":
+			authed = len(args) == 2 && args[1] == srv.password
+			out = respSimple("OK")
+			if !authed {
+				out = respError("WRONGPASS invalid password")
+			}
+		case !authed:
+			out = respError("NOAUTH Authentication required")
+		case cmd == "MULTI":
+			inMulti = true
+			out = respSimple("OK")
+		case cmd == "DISCARD":
+			inMulti, queued = false, nil
+			watched = make(map[string]uint64)
+			out = respSimple("OK")
+		case cmd == "EXEC":
+			out = srv.exec(watched, queued)
+			inMulti, queued = false, nil
+			watched = make(map[string]uint64)
+		case inMulti:
+			queued = append(queued, args)
+			out = respSimple("QUEUED")
+		case cmd == "WATCH":
+			srv.mu.Lock()
+			for _, key := range args[1:] {
+				watched[key] = srv.versions[key]
+			}
+			srv.mu.Unlock()
+			out = respSimple("OK")
+		case cmd == "UNWATCH":
+			watched = make(map[string]uint64)
+			out = respSimple("OK")
+		default:
+			srv.mu.Lock()
+			out = srv.run(args)
+			srv.mu.Unlock()
+		}
+
+		writeRESPValue(w, out)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs queued commands atomically unless a watched key has changed
+func (srv *respTestServer) exec(watched map[string]uint64, queued [][]string) interface{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for key, version := range watched {
+		if srv.versions[key] != version {
+			srv.aborts.Add(1)
+			return nil
+		}
+	}
+
+	replies := make([]interface{}, len(queued))
+	for i, args := range queued {
+		replies[i] = srv.run(args)
+	}
+	return replies
+}
+
+// run executes a data command
+// Must be called with lock held
+func (srv *respTestServer) run(args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return respSimple("PONG")
+	case "GET":
+		v, ok := srv.values[args[1]]
+		if !ok || (!v.expires.IsZero() && time.Now().After(v.expires)) {
+			return nil
+		}
+		return v.value
+	case "SET":
+		v := respValue{value: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.ParseInt(args[4], 10, 64)
+			v.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		srv.values[args[1]] = v
+		srv.versions[args[1]]++
+		return respSimple("OK")
+	case "DEL":
+		_, ok := srv.values[args[1]]
+		delete(srv.values, args[1])
+		srv.versions[args[1]]++
+		if ok {
+			return int64(1)
+		}
+		return int64(0)
+	default:
+		return respError("ERR unknown command '" + args[0] + "'")
+	}
+}
+
+// writeRESPValue encodes a reply value
+func writeRESPValue(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("*-1\r\n")
+	case respSimple:
+		w.WriteString("+" + string(v) + "\r\n")
+	case respError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			writeRESPValue(w, item)
+		}
+	}
+}
+
+func TestRESPStoreTake(t *testing.T) {
+	srv := newRESPTestServer(t, "secret")
+	store := NewRESPStore(RESPStoreConfig{Addr: srv.addr(), Password: "secret"})
+	defer store.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	p := Policy{Capacity: 2, RefillRate: 2, Interval: time.Second}
+
+	for i := int64(1); i >= 0; i-- {
+		result, err := store.Take(ctx, "key", 1, p, now)
+		if err != nil {
+			t.Fatalf("Take failed: %v", err)
+		}
+		if !result.Allowed || result.Remaining != i {
+			t.Fatalf("Expected allowed with %d remaining, got %+v", i, result)
+		}
+	}
+
+	result, err := store.Take(ctx, "key", 1, p, now)
+	if err != nil || result.Allowed || result.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Expected a denial with a 500ms retry, got %+v, %v", result, err)
+	}
+
+	if err := store.Reset(ctx, "key"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if result, _ := store.Take(ctx, "key", 2, p, now); !result.Allowed {
+		t.Error("Expected a full bucket after reset")
+	}
+
+	srv.mu.Lock()
+	_, prefixed := srv.values["ratelimit:key"]
+	srv.mu.Unlock()
+	if !prefixed {
+		t.Error("Expected keys to be stored under the default prefix")
+	}
+}
+
+func TestRESPStoreAuthFailure(t *testing.T) {
+	srv := newRESPTestServer(t, "secret")
+	store := NewRESPStore(RESPStoreConfig{Addr: srv.addr(), Password: "wrong"})
+
+	_, err := store.Take(context.Background(), "key", 1, Policy{Capacity: 1, RefillRate: 1, Interval: time.Second}, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+}
+
+func TestRESPStoreUnreachableFallsBack(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := NewRESPStore(RESPStoreConfig{Addr: addr, Timeout: 100 * time.Millisecond})
+	limiter := NewLimiter(1, 1, time.Minute, WithStore(store))
+
+	if !limiter.Allow("key") || limiter.Allow("key") {
+		t.Error("Expected the local bucket to enforce the limit")
+	}
+	if limiter.Stats()["store_errors"] == uint64(0) {
+		t.Error("Expected store errors to be counted")
+	}
+}
+
+func TestRESPStoreReplicasEnforceOneLimit(t *testing.T) {
+	srv := newRESPTestServer(t, "")
+
+	const replicas = 3
+	limiters := make([]*Limiter, replicas)
+	for i := range limiters {
+		store := NewRESPStore(RESPStoreConfig{Addr: srv.addr(), MaxRetries: 1000})
+		defer store.Close()
+		// A long interval so nothing refills while the test runs
+		limiters[i] = NewLimiter(50, 50, time.Hour, WithStore(store))
+	}
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < replicas*10; i++ {
+		wg.Add(1)
+		go func(l *Limiter) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if l.Allow("client") {
+					allowed.Add(1)
+				}
+			}
+		}(limiters[i%replicas])
+	}
+	wg.Wait()
+
+	for _, l := range limiters {
+		if errs := l.Stats()["store_errors"]; errs != uint64(0) {
+			t.Fatalf("Expected no store errors, got %v", errs)
+		}
+	}
+	if allowed.Load() != 50 {
+		t.Errorf("Expected exactly 50 requests across replicas, got %d", allowed.Load())
+	}
+	t.Logf("%d transactions retried after contention", srv.aborts.Load())
+}
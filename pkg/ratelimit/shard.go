@@ -0,0 +1,258 @@
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShards is the number of shards a Limiter splits its keys across
+const defaultShards = 32
+
+// entry is a key's bucket plus the bookkeeping needed to evict it
+type entry struct {
+	key      string
+	bucket   bucket
+	policy   Policy
+	lastSeen atomic.Int64  // Unix nanoseconds of the last request
+	elem     *list.Element // Position in the shard's LRU list, nil when unbounded
+	allowed  atomic.Uint64 // Requests admitted since the key was added
+	denied   atomic.Uint64 // Requests rejected since the key was added
+
+	// stored is the outcome of the key's last request to the Limiter's
+	// Store, nil without a Store
+	stored atomic.Pointer[storedTake]
+}
+
+// touch records a request for the entry at now
+func (e *entry) touch(now time.Time) {
+	e.lastSeen.Store(now.UnixNano())
+}
+
+// record counts the outcome of a request
+func (e *entry) record(allowed bool) {
+	if allowed {
+		e.allowed.Add(1)
+	} else {
+		e.denied.Add(1)
+	}
+}
+
+// shard holds a subset of a Limiter's keys behind its own lock, so creating
+// or cleaning up keys in one shard doesn't block requests in the others
+type shard struct {
+	entries     map[string]*entry
+	lru         *list.List // Most recently used first; nil when unbounded
+	maxKeys     int        // Maximum keys in this shard, 0 for unbounded
+	lastCleanup time.Time
+	mu          sync.RWMutex
+
+	lruEvictions atomic.Uint64 // Keys dropped to stay under maxKeys
+	ttlEvictions atomic.Uint64 // Partially used keys dropped after idleTTL
+}
+
+func newShard(now time.Time, maxKeys int) *shard {
+	s := &shard{
+		entries:     make(map[string]*entry),
+		maxKeys:     maxKeys,
+		lastCleanup: now,
+	}
+	if maxKeys > 0 {
+		s.lru = list.New()
+	}
+	return s
+}
+
+// get returns the entry for key if it exists and records the access.
+// Unbounded shards only need the read lock; bounded shards take the write
+// lock to keep the LRU order current.
+func (s *shard) get(key string, now time.Time) (*entry, bool) {
+	if s.lru == nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	} else {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	e, exists := s.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	e.touch(now)
+	if s.lru != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	return e, true
+}
+
+// lookup returns the entry for key without recording an access
+func (s *shard) lookup(key string) (*entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, exists := s.entries[key]
+	return e, exists
+}
+
+// add stores a new bucket for key, evicting the least recently used key
+// if the shard is full
+// Must be called with write lock held
+func (s *shard) add(key string, b bucket, p Policy, now time.Time) *entry {
+	e := &entry{key: key, bucket: b, policy: p}
+	e.touch(now)
+
+	if s.lru != nil {
+		for len(s.entries) >= s.maxKeys {
+			oldest := s.lru.Back()
+			s.remove(oldest.Value.(*entry))
+			s.lruEvictions.Add(1)
+		}
+		e.elem = s.lru.PushFront(e)
+	}
+
+	s.entries[key] = e
+	return e
+}
+
+// remove drops an entry from the map and LRU list
+// Must be called with write lock held
+func (s *shard) remove(e *entry) {
+	delete(s.entries, e.key)
+	if s.lru != nil {
+		s.lru.Remove(e.elem)
+	}
+}
+
+// policy returns the policy applied to key if it exists
+func (s *shard) policy(key string) (Policy, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, exists := s.entries[key]
+	if !exists {
+		return Policy{}, false
+	}
+	return e.policy, true
+}
+
+// setPolicy reconfigures key's bucket if it exists, keeping its used requests
+func (s *shard) setPolicy(key string, p Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, exists := s.entries[key]; exists {
+		e.policy = p
+		e.bucket.reconfigure(p, false)
+	}
+}
+
+// len returns the number of keys in the shard
+func (s *shard) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.entries)
+}
+
+// delete removes key from the shard
+func (s *shard) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, exists := s.entries[key]; exists {
+		s.remove(e)
+	}
+}
+
+// reset removes every key from the shard
+func (s *shard) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[string]*entry)
+	if s.lru != nil {
+		s.lru.Init()
+	}
+}
+
+// cleanupIfNeeded removes idle entries once the cleanup interval has passed
+// Must be called with write lock held
+func (s *shard) cleanupIfNeeded(now time.Time, interval, idleTTL time.Duration) {
+	if now.Sub(s.lastCleanup) < interval {
+		return
+	}
+
+	for _, e := range s.entries {
+		if s.expired(e, now, idleTTL) {
+			s.remove(e)
+		}
+	}
+
+	s.lastCleanup = now
+}
+
+// sweep removes idle entries. Candidates are found under the read lock, so
+// requests for existing keys keep flowing, and only the deletions take the
+// write lock. Returns the number of entries removed.
+func (s *shard) sweep(now time.Time, idleTTL time.Duration) int {
+	s.mu.RLock()
+	var idle []*entry
+	for _, e := range s.entries {
+		if isIdle(e, now, idleTTL) {
+			idle = append(idle, e)
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(idle) == 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, e := range idle {
+		// The key may have been used or replaced since it was found idle
+		if s.entries[e.key] == e && s.expired(e, now, idleTTL) {
+			s.remove(e)
+			removed++
+		}
+	}
+	return removed
+}
+
+// expired reports whether an entry should be removed, counting it as a TTL
+// eviction if it still held state
+func (s *shard) expired(e *entry, now time.Time, idleTTL time.Duration) bool {
+	if isFull(e, now) {
+		return true
+	}
+	if isIdle(e, now, idleTTL) {
+		s.ttlEvictions.Add(1)
+		return true
+	}
+	return false
+}
+
+// isIdle reports whether an entry can be removed: its bucket is back at
+// full capacity, or it hasn't been used for idleTTL (when set)
+func isIdle(e *entry, now time.Time, idleTTL time.Duration) bool {
+	if isFull(e, now) {
+		return true
+	}
+	return idleTTL > 0 && now.UnixNano()-e.lastSeen.Load() >= int64(idleTTL)
+}
+
+// isFull reports whether an entry's bucket, and its bucket in the Store if
+// any, are back at full capacity, meaning it hasn't been used recently and
+// can be dropped without losing state
+func isFull(e *entry, now time.Time) bool {
+	if s := e.stored.Load(); s != nil && s.available(now) < s.policy.Capacity {
+		return false
+	}
+	return e.bucket.Available() == e.bucket.Capacity()
+}
@@ -0,0 +1,358 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// logEntry records n requests admitted at the same instant
+type logEntry struct {
+	at time.Time
+	n  int64
+}
+
+// SlidingWindowLog enforces an exact limit over a rolling window by keeping
+// a log of admitted requests. Memory grows with the number of requests in
+// the window, so it suits low to moderate limits.
+// Safe for concurrent use by multiple goroutines
+type SlidingWindowLog struct {
+	limit  int64         // Maximum requests per window
+	window time.Duration // Length of the rolling window
+	log    []logEntry    // Admitted requests, oldest first
+	count  int64         // Sum of n over log
+	clock  Clock
+	mu     sync.Mutex
+}
+
+// NewSlidingWindowLog creates a limiter allowing limit requests in any rolling window
+func NewSlidingWindowLog(limit int64, window time.Duration, opts ...Option) *SlidingWindowLog {
+	return newSlidingWindowLog(limit, window, newOptions(opts))
+}
+
+func newSlidingWindowLog(limit int64, window time.Duration, o options) *SlidingWindowLog {
+	return &SlidingWindowLog{
+		limit:  limit,
+		window: window,
+		clock:  o.clock,
+	}
+}
+
+// Allow checks if a request can proceed and records it if so
+func (sw *SlidingWindowLog) Allow() bool {
+	return sw.AllowN(1)
+}
+
+// AllowN checks if n requests fit in the current window and records them if so
+func (sw *SlidingWindowLog) AllowN(n int64) bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	now := sw.clock.Now()
+	sw.evict(now)
+
+	if sw.count+n > sw.limit {
+		return false
+	}
+
+	sw.log = append(sw.log, logEntry{at: now, n: n})
+	sw.count += n
+	return true
+}
+
+// evict drops log entries that have left the window
+// Must be called with lock held
+func (sw *SlidingWindowLog) evict(now time.Time) {
+	cutoff := now.Add(-sw.window)
+
+	i := 0
+	for i < len(sw.log) && !sw.log[i].at.After(cutoff) {
+		sw.count -= sw.log[i].n
+		i++
+	}
+
+	if i > 0 {
+		sw.log = append(sw.log[:0], sw.log[i:]...)
+	}
+}
+
+// Available returns how many more requests the current window admits
+func (sw *SlidingWindowLog) Available() int64 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.evict(sw.clock.Now())
+	return sw.limit - sw.count
+}
+
+// TimeUntil returns how long until n more requests fit in the window, or 0
+// if they already do. It returns InfDuration if n exceeds the limit.
+func (sw *SlidingWindowLog) TimeUntil(n int64) time.Duration {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if n > sw.limit {
+		return InfDuration
+	}
+
+	now := sw.clock.Now()
+	sw.evict(now)
+
+	excess := sw.count + n - sw.limit
+	if excess <= 0 {
+		return 0
+	}
+
+	// Wait for the oldest entries to leave the window until enough room is freed
+	for _, entry := range sw.log {
+		excess -= entry.n
+		if excess <= 0 {
+			return entry.at.Add(sw.window).Sub(now)
+		}
+	}
+
+	return InfDuration
+}
+
+// reconfigure applies new limits, keeping the logged requests or, with
+// rescale, their share of the limit. Requests beyond the new limit are
+// dropped, oldest first.
+func (sw *SlidingWindowLog) reconfigure(p Policy, rescale bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if rescale {
+		sw.count = 0
+		for i := range sw.log {
+			sw.log[i].n = scale(sw.log[i].n, sw.limit, p.Capacity)
+			sw.count += sw.log[i].n
+		}
+	}
+	for sw.count > p.Capacity && len(sw.log) > 0 {
+		dropped := min(sw.count-p.Capacity, sw.log[0].n)
+		sw.log[0].n -= dropped
+		sw.count -= dropped
+		if sw.log[0].n == 0 {
+			sw.log = sw.log[1:]
+		}
+	}
+
+	sw.limit = p.Capacity
+	sw.window = p.Window()
+}
+
+// refund removes the n most recently recorded requests from the log
+func (sw *SlidingWindowLog) refund(n int64) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	for n > 0 && len(sw.log) > 0 {
+		last := &sw.log[len(sw.log)-1]
+		taken := min(n, last.n)
+		last.n -= taken
+		sw.count -= taken
+		n -= taken
+		if last.n == 0 {
+			sw.log = sw.log[:len(sw.log)-1]
+		}
+	}
+}
+
+// state returns the logged requests
+func (sw *SlidingWindowLog) state() bucketState {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	log := make([]logState, len(sw.log))
+	for i, entry := range sw.log {
+		log[i] = logState{At: entry.at, N: entry.n}
+	}
+	return bucketState{Log: log}
+}
+
+// setState restores the logged requests saved by state. Entries that left
+// the window in the meantime are evicted by the next request.
+func (sw *SlidingWindowLog) setState(s bucketState) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.log = make([]logEntry, len(s.Log))
+	sw.count = 0
+	for i, entry := range s.Log {
+		sw.log[i] = logEntry{at: entry.At, n: entry.N}
+		sw.count += entry.N
+	}
+}
+
+// Capacity returns the maximum number of requests per window
+func (sw *SlidingWindowLog) Capacity() int64 {
+	return sw.limit
+}
+
+// SlidingWindowCounter approximates a rolling window using two fixed windows.
+// The previous window's count is weighted by how much of it still overlaps
+// the rolling window, which keeps memory constant per key.
+// Safe for concurrent use by multiple goroutines
+type SlidingWindowCounter struct {
+	limit    int64         // Maximum requests per window
+	window   time.Duration // Length of each fixed window
+	start    time.Time     // Start of the current fixed window
+	current  int64         // Requests admitted in the current window
+	previous int64         // Requests admitted in the previous window
+	clock    Clock
+	mu       sync.Mutex
+}
+
+// NewSlidingWindowCounter creates a limiter allowing roughly limit requests in any rolling window
+func NewSlidingWindowCounter(limit int64, window time.Duration, opts ...Option) *SlidingWindowCounter {
+	return newSlidingWindowCounter(limit, window, newOptions(opts))
+}
+
+func newSlidingWindowCounter(limit int64, window time.Duration, o options) *SlidingWindowCounter {
+	return &SlidingWindowCounter{
+		limit:  limit,
+		window: window,
+		start:  o.clock.Now(),
+		clock:  o.clock,
+	}
+}
+
+// Allow checks if a request can proceed and counts it if so
+func (sc *SlidingWindowCounter) Allow() bool {
+	return sc.AllowN(1)
+}
+
+// AllowN checks if n requests fit in the estimated window count and counts them if so
+func (sc *SlidingWindowCounter) AllowN(n int64) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := sc.clock.Now()
+	sc.advance(now)
+
+	if sc.estimate(now)+float64(n) > float64(sc.limit) {
+		return false
+	}
+
+	sc.current += n
+	return true
+}
+
+// advance rolls the fixed windows forward to contain now
+// Must be called with lock held
+func (sc *SlidingWindowCounter) advance(now time.Time) {
+	elapsed := now.Sub(sc.start)
+	if elapsed < sc.window {
+		return
+	}
+
+	windows := elapsed / sc.window
+	if windows == 1 {
+		sc.previous = sc.current
+	} else {
+		// The previous window saw no traffic
+		sc.previous = 0
+	}
+	sc.current = 0
+	sc.start = sc.start.Add(windows * sc.window)
+}
+
+// estimate returns the weighted request count for the rolling window ending at now
+// Must be called with lock held
+func (sc *SlidingWindowCounter) estimate(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(sc.start))/float64(sc.window)
+	return float64(sc.previous)*overlap + float64(sc.current)
+}
+
+// Available returns how many more requests the estimated window admits
+func (sc *SlidingWindowCounter) Available() int64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := sc.clock.Now()
+	sc.advance(now)
+
+	available := int64(float64(sc.limit) - sc.estimate(now))
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// TimeUntil returns how long until the estimated window count leaves room
+// for n more requests, or 0 if it already does. It returns InfDuration if n
+// exceeds the limit.
+func (sc *SlidingWindowCounter) TimeUntil(n int64) time.Duration {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if n > sc.limit {
+		return InfDuration
+	}
+
+	now := sc.clock.Now()
+	sc.advance(now)
+
+	if sc.estimate(now)+float64(n) <= float64(sc.limit) {
+		return 0
+	}
+
+	// Room left once the previous window's weight decays far enough
+	room := float64(sc.limit - sc.current - n)
+	if room >= 0 && sc.previous > 0 {
+		fraction := 1 - room/float64(sc.previous)
+		return sc.start.Add(time.Duration(fraction * float64(sc.window))).Sub(now)
+	}
+
+	// Otherwise wait until the current window becomes the previous one and decays
+	fraction := 0.0
+	if sc.current > 0 {
+		fraction = 1 - float64(sc.limit-n)/float64(sc.current)
+	}
+	return sc.start.Add(sc.window + time.Duration(fraction*float64(sc.window))).Sub(now)
+}
+
+// reconfigure applies new limits, keeping both window counts or, with
+// rescale, their share of the limit
+func (sc *SlidingWindowCounter) reconfigure(p Policy, rescale bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.advance(sc.clock.Now())
+	sc.current = carry(sc.current, sc.limit, p.Capacity, rescale)
+	sc.previous = carry(sc.previous, sc.limit, p.Capacity, rescale)
+	sc.limit = p.Capacity
+	sc.window = p.Window()
+}
+
+// refund removes n requests from the current window's count
+func (sc *SlidingWindowCounter) refund(n int64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.advance(sc.clock.Now())
+	sc.current = max(sc.current-n, 0)
+}
+
+// state returns the fixed windows' start and counts
+func (sc *SlidingWindowCounter) state() bucketState {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return bucketState{At: sc.start, Current: sc.current, Previous: sc.previous}
+}
+
+// setState restores the fixed windows saved by state. Windows that passed
+// in the meantime are rolled forward by the next request.
+func (sc *SlidingWindowCounter) setState(s bucketState) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.start = s.At
+	sc.current = s.Current
+	sc.previous = s.Previous
+}
+
+// Capacity returns the maximum number of requests per window
+func (sc *SlidingWindowCounter) Capacity() int64 {
+	return sc.limit
+}
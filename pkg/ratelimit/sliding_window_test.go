@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowLogAllow(t *testing.T) {
+	sw := NewSlidingWindowLog(5, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		if !sw.Allow() {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+
+	if sw.Allow() {
+		t.Error("Request 6 should be denied")
+	}
+
+	if sw.Available() != 0 {
+		t.Errorf("Expected 0 available, got %d", sw.Available())
+	}
+}
+
+func TestSlidingWindowLogAllowN(t *testing.T) {
+	sw := NewSlidingWindowLog(10, time.Minute)
+
+	if !sw.AllowN(7) {
+		t.Error("AllowN(7) should succeed")
+	}
+
+	if sw.AllowN(4) {
+		t.Error("AllowN(4) should fail - only 3 left")
+	}
+
+	if !sw.AllowN(3) {
+		t.Error("AllowN(3) should succeed")
+	}
+}
+
+func TestSlidingWindowLogRollingWindow(t *testing.T) {
+	clock := newTestClock()
+	sw := NewSlidingWindowLog(4, 100*time.Millisecond, WithClock(clock))
+
+	sw.AllowN(2)
+	clock.Advance(60 * time.Millisecond)
+	sw.AllowN(2)
+
+	if wait := sw.TimeUntil(1); wait != 40*time.Millisecond {
+		t.Errorf("Expected to wait 40ms for the oldest entries to expire, got %v", wait)
+	}
+
+	// Window is full; a fixed window would have reset by now
+	clock.Advance(40 * time.Millisecond)
+	if !sw.AllowN(2) {
+		t.Error("Expected the first two requests to have left the window")
+	}
+	if sw.Allow() {
+		t.Error("Expected the window to be full again")
+	}
+}
+
+func TestSlidingWindowCounterAllow(t *testing.T) {
+	sc := NewSlidingWindowCounter(5, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		if !sc.Allow() {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+
+	if sc.Allow() {
+		t.Error("Request 6 should be denied")
+	}
+}
+
+func TestSlidingWindowCounterWeightsPreviousWindow(t *testing.T) {
+	clock := newTestClock()
+	sc := NewSlidingWindowCounter(10, 100*time.Millisecond, WithClock(clock))
+
+	if !sc.AllowN(10) {
+		t.Fatal("AllowN(10) should succeed")
+	}
+
+	// Just past the window boundary most of the previous window still counts,
+	// so the limit cannot be doubled across the boundary
+	clock.Advance(110 * time.Millisecond)
+	if sc.AllowN(5) {
+		t.Error("Expected the previous window to still be weighted")
+	}
+
+	// 10 * 0.9 = 9 requests still count, leaving room for one
+	if available := sc.Available(); available != 1 {
+		t.Errorf("Expected 1 available, got %d", available)
+	}
+
+	// Halfway through the window half of the previous window still counts
+	if wait := sc.TimeUntil(5); wait != 40*time.Millisecond {
+		t.Errorf("Expected to wait 40ms for room for 5, got %v", wait)
+	}
+
+	// Two windows later the old traffic no longer counts
+	clock.Advance(200 * time.Millisecond)
+	if !sc.AllowN(10) {
+		t.Error("Expected a full window after two idle windows")
+	}
+}
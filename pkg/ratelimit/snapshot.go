@@ -0,0 +1,219 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshotVersion is the format version written by Snapshot. Restore
+// rejects snapshots with any other version.
+const snapshotVersion = 1
+
+// ErrIncompatibleSnapshot is returned by Restore when a snapshot was written
+// in another format version or for another algorithm
+var ErrIncompatibleSnapshot = errors.New("ratelimit: incompatible snapshot")
+
+// snapshot is the saved state of a Limiter
+type snapshot struct {
+	Version   int               `json:"version"`
+	TakenAt   time.Time         `json:"taken_at"`
+	Algorithm string            `json:"algorithm"`
+	Policies  map[string]Policy `json:"policies,omitempty"` // Set with SetPolicy
+	Keys      []keySnapshot     `json:"keys"`
+}
+
+// keySnapshot is the saved state of one key
+type keySnapshot struct {
+	Key      string      `json:"key"`
+	Policy   Policy      `json:"policy"`
+	LastSeen time.Time   `json:"last_seen"`
+	State    bucketState `json:"state"`
+}
+
+// bucketState is the saved state of a bucket. Each algorithm uses the
+// fields it needs; times are absolute, so a restored bucket catches up on
+// the time the process was down as soon as it is used.
+type bucketState struct {
+	Tokens   int64      `json:"tokens,omitempty"`   // Token bucket tokens
+	Credit   int64      `json:"credit,omitempty"`   // Token bucket continuous refill progress
+	At       time.Time  `json:"at"`                 // Last refill, window start or GCRA TAT
+	Current  int64      `json:"current,omitempty"`  // Sliding window counter's current count
+	Previous int64      `json:"previous,omitempty"` // Sliding window counter's previous count
+	Log      []logState `json:"log,omitempty"`      // Sliding window log entries
+}
+
+// logState is a saved sliding window log entry
+type logState struct {
+	At time.Time `json:"at"`
+	N  int64     `json:"n"`
+}
+
+// Snapshot writes the state of every key, and the policies set with
+// SetPolicy, to w as versioned JSON
+func (l *Limiter) Snapshot(w io.Writer) error {
+	snap := snapshot{
+		Version:   snapshotVersion,
+		TakenAt:   l.opts.clock.Now(),
+		Algorithm: l.opts.algorithm.String(),
+	}
+
+	l.policyMu.RLock()
+	if len(l.overrides) > 0 {
+		snap.Policies = make(map[string]Policy, len(l.overrides))
+		for key, p := range l.overrides {
+			snap.Policies[key] = p
+		}
+	}
+	l.policyMu.RUnlock()
+
+	for _, s := range l.shards {
+		s.mu.RLock()
+		for _, e := range s.entries {
+			snap.Keys = append(snap.Keys, keySnapshot{
+				Key:      e.key,
+				Policy:   e.policy,
+				LastSeen: time.Unix(0, e.lastSeen.Load()),
+				State:    e.bucket.state(),
+			})
+		}
+		s.mu.RUnlock()
+	}
+
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return fmt.Errorf("ratelimit: writing snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore loads a snapshot written by Snapshot, replacing the state of the
+// keys it contains. Buckets are refilled for the time since they were saved.
+// Keys whose policy has changed since are reconfigured to the current
+// policy, keeping their used share. With WithMaxKeys, the most recently
+// seen keys are kept. Zero fields in saved policies are taken from the
+// limiter's default policy; if any policy is still invalid, nothing is
+// restored.
+func (l *Limiter) Restore(r io.Reader) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("ratelimit: reading snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("%w: version %d, want %d", ErrIncompatibleSnapshot, snap.Version, snapshotVersion)
+	}
+	if snap.Algorithm != l.opts.algorithm.String() {
+		return fmt.Errorf("%w: written for %s, limiter uses %s", ErrIncompatibleSnapshot, snap.Algorithm, l.opts.algorithm)
+	}
+
+	defaults := l.defaultPolicy()
+	for key, p := range snap.Policies {
+		if err := p.withDefaults(defaults).validate(); err != nil {
+			return fmt.Errorf("ratelimit: reading snapshot: policy for key %s: %w", key, err)
+		}
+	}
+	for i, k := range snap.Keys {
+		snap.Keys[i].Policy = k.Policy.withDefaults(defaults)
+		if err := snap.Keys[i].Policy.validate(); err != nil {
+			return fmt.Errorf("ratelimit: reading snapshot: state of key %s: %w", k.Key, err)
+		}
+	}
+
+	l.policyMu.Lock()
+	for key, p := range snap.Policies {
+		l.overrides[key] = p
+	}
+	l.policyMu.Unlock()
+
+	// Add the least recently seen keys first, so they are evicted first
+	sort.Slice(snap.Keys, func(i, j int) bool {
+		return snap.Keys[i].LastSeen.Before(snap.Keys[j].LastSeen)
+	})
+
+	for _, k := range snap.Keys {
+		b := l.newBucket(k.Policy)
+		b.setState(k.State)
+
+		p := l.resolvePolicy(k.Key)
+		if p != k.Policy {
+			b.reconfigure(p, true)
+		}
+
+		s := l.shardFor(k.Key)
+		s.mu.Lock()
+		if e, exists := s.entries[k.Key]; exists {
+			s.remove(e)
+		}
+		s.add(k.Key, b, p, k.LastSeen)
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+// SaveFile writes a snapshot to path. The snapshot is written to a
+// temporary file first and renamed into place, so a crash mid-write
+// leaves the previous snapshot intact.
+func (l *Limiter) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("ratelimit: saving snapshot: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := l.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("ratelimit: saving snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("ratelimit: saving snapshot: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("ratelimit: saving snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadFile restores a snapshot saved by SaveFile or WithCheckpoint.
+// A missing file returns an error matching fs.ErrNotExist.
+func (l *Limiter) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("ratelimit: loading snapshot: %w", err)
+	}
+	defer f.Close()
+
+	return l.Restore(f)
+}
+
+// checkpoint saves a snapshot every checkpoint interval, and once more when
+// the limiter is stopped
+func (l *Limiter) checkpoint() {
+	defer close(l.checkpointDone)
+
+	for {
+		select {
+		case <-l.opts.clock.After(l.opts.checkpointInterval):
+			l.saveCheckpoint()
+		case <-l.stop:
+			l.saveCheckpoint()
+			return
+		}
+	}
+}
+
+// saveCheckpoint writes a checkpoint, reporting any failure to the error callback
+func (l *Limiter) saveCheckpoint() {
+	if err := l.SaveFile(l.opts.checkpointPath); err != nil && l.opts.checkpointErr != nil {
+		l.opts.checkpointErr(err)
+	}
+}
@@ -0,0 +1,197 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLimiterSnapshotRestore(t *testing.T) {
+	algorithms := []Algorithm{
+		TokenBucketAlgorithm,
+		SlidingWindowLogAlgorithm,
+		SlidingWindowCounterAlgorithm,
+		GCRAAlgorithm,
+		AtomicTokenBucketAlgorithm,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			clock := newTestClock()
+			limiter := NewLimiter(4, 4, 4*time.Second, WithClock(clock), WithAlgorithm(algorithm))
+			for limiter.Allow("abuser") {
+			}
+
+			var buf bytes.Buffer
+			if err := limiter.Snapshot(&buf); err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+
+			// A restarted process must not hand the key a fresh quota
+			restored := NewLimiter(4, 4, 4*time.Second, WithClock(clock), WithAlgorithm(algorithm))
+			if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+			if restored.Allow("abuser") {
+				t.Error("Expected the restored key to still be limited")
+			}
+
+			// Time spent down counts towards refilling
+			clock.Advance(8 * time.Second)
+			if !restored.Allow("abuser") {
+				t.Error("Expected the restored key to refill for the time since the snapshot")
+			}
+		})
+	}
+}
+
+func TestLimiterRestoreKeepsPolicies(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(10, 10, time.Minute, WithClock(clock))
+	limiter.SetPolicy("pro", Policy{Name: "pro", Capacity: 100})
+	limiter.AllowN("pro", 50)
+
+	var buf bytes.Buffer
+	if err := limiter.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	restored := NewLimiter(10, 10, time.Minute, WithClock(clock))
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if p := restored.Policy("pro"); p.Name != "pro" || p.Capacity != 100 {
+		t.Errorf("Expected the pro policy to be restored, got %+v", p)
+	}
+	if !restored.AllowN("pro", 50) || restored.Allow("pro") {
+		t.Error("Expected exactly the 50 remaining tokens to be restored")
+	}
+}
+
+func TestLimiterRestoreRescalesChangedDefault(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(10, 10, time.Minute, WithClock(clock))
+	limiter.AllowN("key", 5)
+
+	var buf bytes.Buffer
+	limiter.Snapshot(&buf)
+
+	// Deployed with double the limit: the key keeps half its allowance
+	restored := NewLimiter(20, 20, time.Minute, WithClock(clock))
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if !restored.AllowN("key", 10) || restored.Allow("key") {
+		t.Error("Expected 10 of 20 tokens after rescaling")
+	}
+}
+
+func TestLimiterRestoreRejectsIncompatible(t *testing.T) {
+	limiter := NewLimiter(10, 10, time.Minute)
+	limiter.Allow("key")
+
+	var buf bytes.Buffer
+	limiter.Snapshot(&buf)
+
+	gcra := NewLimiter(10, 10, time.Minute, WithAlgorithm(GCRAAlgorithm))
+	if err := gcra.Restore(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrIncompatibleSnapshot) {
+		t.Errorf("Expected ErrIncompatibleSnapshot for another algorithm, got %v", err)
+	}
+
+	var snap map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &snap)
+	snap["version"] = snapshotVersion + 1
+	future, _ := json.Marshal(snap)
+
+	if err := limiter.Restore(bytes.NewReader(future)); !errors.Is(err, ErrIncompatibleSnapshot) {
+		t.Errorf("Expected ErrIncompatibleSnapshot for another version, got %v", err)
+	}
+}
+
+func TestLimiterRestoreValidatesPolicies(t *testing.T) {
+	algorithms := []Algorithm{
+		TokenBucketAlgorithm,
+		SlidingWindowLogAlgorithm,
+		SlidingWindowCounterAlgorithm,
+		GCRAAlgorithm,
+		AtomicTokenBucketAlgorithm,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			clock := newTestClock()
+			snapshotWith := func(policy string) *bytes.Reader {
+				return bytes.NewReader(fmt.Appendf(nil,
+					`{"version":%d,"taken_at":%q,"algorithm":%q,"keys":[{"key":"key","policy":%s,"last_seen":%[2]q,"state":{"at":%[2]q}}]}`,
+					snapshotVersion, clock.Now().Format(time.RFC3339), algorithm, policy))
+			}
+
+			// Missing limits are taken from the default policy
+			limiter := NewLimiter(10, 10, time.Minute, WithClock(clock), WithAlgorithm(algorithm))
+			if err := limiter.Restore(snapshotWith(`{}`)); err != nil {
+				t.Fatalf("Expected an empty policy to be restored, got %v", err)
+			}
+			if p := limiter.Policy("key"); p.Capacity != 10 || p.Interval != time.Minute {
+				t.Errorf("Expected the default policy, got %+v", p)
+			}
+
+			limiter = NewLimiter(10, 10, time.Minute, WithClock(clock), WithAlgorithm(algorithm))
+			if err := limiter.Restore(snapshotWith(`{"capacity":-1}`)); err == nil {
+				t.Error("Expected an error for a negative capacity")
+			}
+			if _, ok := limiter.Inspect("key"); ok {
+				t.Error("Expected nothing to be restored from an invalid snapshot")
+			}
+		})
+	}
+
+	limiter := NewLimiter(10, 10, time.Minute)
+	invalid := fmt.Appendf(nil, `{"version":%d,"algorithm":"token_bucket","policies":{"key":{"interval":-1}}}`, snapshotVersion)
+	if err := limiter.Restore(bytes.NewReader(invalid)); err == nil {
+		t.Error("Expected an error for a negative interval")
+	}
+}
+
+func TestLimiterCheckpoint(t *testing.T) {
+	clock := newTestClock()
+	path := filepath.Join(t.TempDir(), "limiter.json")
+
+	limiter := NewLimiter(5, 5, time.Hour, WithClock(clock), WithCheckpoint(path, time.Minute, func(err error) {
+		t.Errorf("Checkpoint failed: %v", err)
+	}))
+
+	fresh := NewLimiter(5, 5, time.Hour, WithClock(clock))
+	if err := fresh.LoadFile(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist before the first checkpoint, got %v", err)
+	}
+
+	limiter.AllowN("key", 5)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1) // The first checkpoint has been written
+
+	if err := fresh.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if fresh.Allow("key") {
+		t.Error("Expected the checkpointed key to be limited")
+	}
+
+	// Stop writes a final checkpoint
+	limiter.Allow("late")
+	limiter.Stop()
+
+	final := NewLimiter(5, 5, time.Hour, WithClock(clock))
+	if err := final.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if final.Stats()["total_keys"] != 2 {
+		t.Errorf("Expected both keys in the final checkpoint, got %v", final.Stats()["total_keys"])
+	}
+}
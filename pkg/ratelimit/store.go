@@ -0,0 +1,229 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store holds rate limit state outside a Limiter, so that several Limiters,
+// such as the replicas of a gateway, enforce one limit between them.
+// Stores implement a token bucket that refills continuously, kept as the
+// time the bucket will next be full (its theoretical arrival time), so one
+// timestamp per key is enough and every update is a single atomic step.
+// Replicas sharing a store should have closely synchronised clocks.
+type Store interface {
+	// Take atomically refills key's bucket under policy p as of now and
+	// takes n tokens if that many are available. A negative n gives
+	// tokens back.
+	Take(ctx context.Context, key string, n int64, p Policy, now time.Time) (TakeResult, error)
+
+	// Reset removes the state stored for key
+	Reset(ctx context.Context, key string) error
+}
+
+// TakeResult is the outcome of Store.Take
+type TakeResult struct {
+	// Allowed reports whether the tokens were taken
+	Allowed bool
+
+	// Remaining is the number of tokens left in the bucket
+	Remaining int64
+
+	// RetryAfter is how long until the tokens could be taken, 0 if they were
+	// and InfDuration if they never can be
+	RetryAfter time.Duration
+}
+
+// takeTAT applies Take to a bucket stored as its theoretical arrival time
+// (Unix nanoseconds; 0 for a new key). It returns the new TAT to store,
+// which is 0 once the bucket is full again. A bucket that never refills is
+// measured against frozenTime, so its state doesn't expire.
+func takeTAT(tat int64, n int64, p Policy, now time.Time) (int64, TakeResult) {
+	perToken, refills := emissionFor(p.RefillRate, p.Interval)
+	if !refills {
+		now = frozenTime
+	}
+	emission := int64(perToken)
+	tolerance := p.Capacity * emission
+	nowNano := now.UnixNano()
+	if tat < nowNano {
+		tat = nowNano
+	}
+
+	newTat := tat + n*emission
+	if ahead := newTat - nowNano; ahead > tolerance {
+		result := TakeResult{
+			Remaining:  max((tolerance-(tat-nowNano))/emission, 0),
+			RetryAfter: time.Duration(ahead - tolerance),
+		}
+		if n > p.Capacity || !refills {
+			result.RetryAfter = InfDuration
+		}
+		return storedTAT(tat, nowNano), result
+	}
+
+	return storedTAT(newTat, nowNano), TakeResult{
+		Allowed:   true,
+		Remaining: (tolerance - (newTat - nowNano)) / emission,
+	}
+}
+
+// storedTAT returns the TAT to store, 0 when the bucket is full
+func storedTAT(tat, now int64) int64 {
+	if tat <= now {
+		return 0
+	}
+	return tat
+}
+
+// MemoryStore is a Store kept in process memory. It lets Limiters in the
+// same process share limits, and stands in for a remote store in tests.
+// Safe for concurrent use by multiple goroutines
+type MemoryStore struct {
+	tats        map[string]int64 // Theoretical arrival time per key, Unix nanoseconds
+	lastCleanup time.Time
+	mu          sync.Mutex
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tats: make(map[string]int64),
+	}
+}
+
+// Take refills key's bucket and takes n tokens if available
+func (m *MemoryStore) Take(ctx context.Context, key string, n int64, p Policy, now time.Time) (TakeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return TakeResult{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cleanupIfNeeded(now)
+
+	tat, result := takeTAT(m.tats[key], n, p, now)
+	if tat == 0 {
+		delete(m.tats, key)
+	} else {
+		m.tats[key] = tat
+	}
+	return result, nil
+}
+
+// Reset removes the state stored for key
+func (m *MemoryStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.tats, key)
+	return nil
+}
+
+// Len returns the number of keys whose buckets aren't full
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.tats)
+}
+
+// cleanupIfNeeded removes keys whose buckets have refilled, at most once a minute
+// Must be called with lock held
+func (m *MemoryStore) cleanupIfNeeded(now time.Time) {
+	if now.Sub(m.lastCleanup) < time.Minute {
+		return
+	}
+
+	for key, tat := range m.tats {
+		if tat <= now.UnixNano() {
+			delete(m.tats, key)
+		}
+	}
+	m.lastCleanup = now
+}
+
+// takeFromStore takes n tokens for key from the limiter's store. If the
+// store fails, the limiter falls back to its local bucket for the key, so an
+// unreachable store degrades to per-replica limits instead of an outage.
+// The key's local entry is kept either way, to track its requests.
+func (l *Limiter) takeFromStore(ctx context.Context, key string, n int64) (TakeResult, *entry, error) {
+	p := l.resolvePolicy(key)
+	now := l.opts.clock.Now()
+	e := l.getEntry(key)
+
+	result, err := l.opts.store.Take(ctx, l.opts.storePrefix+key, n, p, now)
+	if err != nil {
+		l.storeErrors.Add(1)
+		return result, e, err
+	}
+	e.stored.Store(&storedTake{remaining: result.Remaining, policy: p, at: now})
+	return result, e, nil
+}
+
+// storedTake is what a Limiter knows of a key's bucket in its Store: the
+// tokens left after the key's last request. The tokens earned since are
+// estimated from the policy, in whole tokens, so estimates may run up to
+// one token behind the store.
+type storedTake struct {
+	remaining int64
+	policy    Policy
+	at        time.Time
+}
+
+// available estimates the tokens in the stored bucket at now
+func (s *storedTake) available(now time.Time) int64 {
+	emission, refills := emissionFor(s.policy.RefillRate, s.policy.Interval)
+	if !refills || now.Before(s.at) {
+		return s.remaining
+	}
+	earned := int64(now.Sub(s.at) / emission)
+	return min(s.remaining+earned, s.policy.Capacity)
+}
+
+// timeUntil estimates how long after now the stored bucket holds n tokens
+func (s *storedTake) timeUntil(n int64, now time.Time) time.Duration {
+	if n > s.policy.Capacity {
+		return InfDuration
+	}
+	missing := n - s.remaining
+	if missing <= 0 {
+		return 0
+	}
+	emission, refills := emissionFor(s.policy.RefillRate, s.policy.Interval)
+	if !refills {
+		return InfDuration
+	}
+	return max(s.at.Add(time.Duration(missing)*emission).Sub(now), 0)
+}
+
+// waitStore blocks until n tokens can be taken from the store for key
+func (l *Limiter) waitStore(ctx context.Context, key string, n int64) error {
+	for {
+		result, e, err := l.takeFromStore(ctx, key, n)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return l.waitEntry(ctx, e, n)
+		}
+		if result.Allowed {
+			l.admitted(e)
+			return nil
+		}
+		if result.RetryAfter == InfDuration {
+			return ErrExceedsCapacity
+		}
+		if deadline, ok := ctx.Deadline(); ok && l.opts.clock.Now().Add(result.RetryAfter).After(deadline) {
+			return ErrWouldExceedDeadline
+		}
+
+		select {
+		case <-l.opts.clock.After(result.RetryAfter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStore()
+	p := Policy{Capacity: 3, RefillRate: 1, Interval: time.Second}
+	ctx := context.Background()
+
+	for i := int64(2); i >= 0; i-- {
+		result, _ := store.Take(ctx, "key", 1, p, clock.Now())
+		if !result.Allowed || result.Remaining != i {
+			t.Fatalf("Expected allowed with %d remaining, got %+v", i, result)
+		}
+	}
+
+	result, _ := store.Take(ctx, "key", 1, p, clock.Now())
+	if result.Allowed || result.RetryAfter != time.Second {
+		t.Errorf("Expected a denial with a 1s retry, got %+v", result)
+	}
+
+	// Tokens refill continuously and can be given back
+	clock.Advance(time.Second)
+	if result, _ := store.Take(ctx, "key", 1, p, clock.Now()); !result.Allowed {
+		t.Error("Expected a token after 1s")
+	}
+	store.Take(ctx, "key", -3, p, clock.Now())
+	if result, _ := store.Take(ctx, "key", 3, p, clock.Now()); !result.Allowed {
+		t.Error("Expected refunded tokens to be available")
+	}
+
+	if result, _ := store.Take(ctx, "key", 4, p, clock.Now()); result.RetryAfter != InfDuration {
+		t.Errorf("Expected InfDuration beyond capacity, got %v", result.RetryAfter)
+	}
+
+	// Full buckets don't take up memory
+	clock.Advance(time.Hour)
+	store.Take(ctx, "other", 1, p, clock.Now())
+	if store.Len() != 1 {
+		t.Errorf("Expected only the used key to be stored, got %d", store.Len())
+	}
+}
+
+func TestLimitersSharingStoreEnforceOneLimit(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStore()
+
+	replicas := []*Limiter{
+		NewLimiter(10, 10, time.Minute, WithClock(clock), WithStore(store)),
+		NewLimiter(10, 10, time.Minute, WithClock(clock), WithStore(store)),
+		NewLimiter(10, 10, time.Minute, WithClock(clock), WithStore(store)),
+	}
+
+	allowed := 0
+	for i := 0; i < 30; i++ {
+		if replicas[i%len(replicas)].Allow("client") {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("Expected 10 requests across replicas, got %d", allowed)
+	}
+
+	replicas[0].Reset("client")
+	if !replicas[1].Allow("client") {
+		t.Error("Expected a reset on one replica to apply to all")
+	}
+
+	other := NewLimiter(10, 10, time.Minute, WithClock(clock), WithStore(store), WithStorePrefix("route:"))
+	if !other.AllowN("client", 10) {
+		t.Error("Expected a limiter with another prefix to keep its own limit")
+	}
+}
+
+// failingStore is a Store whose calls always fail
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, int64, Policy, time.Time) (TakeResult, error) {
+	return TakeResult{}, errors.New("store unavailable")
+}
+
+func (failingStore) Reset(context.Context, string) error {
+	return errors.New("store unavailable")
+}
+
+func TestLimiterStoreFallback(t *testing.T) {
+	limiter := NewLimiter(2, 2, time.Minute, WithStore(failingStore{}))
+
+	// Limits still apply locally while the store is down
+	if !limiter.Allow("key") || !limiter.Allow("key") || limiter.Allow("key") {
+		t.Error("Expected the local bucket to enforce the limit")
+	}
+	if errs := limiter.Stats()["store_errors"]; errs != uint64(3) {
+		t.Errorf("Expected 3 store errors, got %v", errs)
+	}
+}
+
+func TestLimiterWaitWithStore(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(1, 1, time.Second, WithClock(clock), WithStore(NewMemoryStore()))
+	limiter.Allow("key")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.Wait(context.Background(), "key")
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected wait to succeed, got %v", err)
+	}
+	if err := limiter.WaitN(context.Background(), "key", 2); !errors.Is(err, ErrExceedsCapacity) {
+		t.Errorf("Expected ErrExceedsCapacity, got %v", err)
+	}
+}
+
+func TestLimiterStoreTracksKeys(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(2, 1, time.Minute, WithClock(clock), WithStore(NewMemoryStore()))
+	for i := 0; i < 3; i++ {
+		limiter.Allow("key")
+	}
+
+	info, ok := limiter.Inspect("key")
+	if !ok || info.Allowed != 2 || info.Denied != 1 || !info.LastSeen.Equal(clock.Now()) {
+		t.Fatalf("Expected 2 allowed and 1 denied just now, got %+v (ok=%v)", info, ok)
+	}
+	if info.Remaining != 0 || !info.NextRefill.Equal(clock.Now().Add(time.Minute)) || !info.ResetAt.Equal(clock.Now().Add(2*time.Minute)) {
+		t.Errorf("Expected the store's bucket to be reported, got %+v", info)
+	}
+	if top := limiter.TopThrottled(1); len(top) != 1 || top[0].Key != "key" {
+		t.Errorf("Expected key to be the top throttled, got %+v", top)
+	}
+
+	clock.Advance(time.Minute)
+	if info, _ := limiter.Inspect("key"); info.Remaining != 1 {
+		t.Errorf("Expected a token refilled in the store, got %d", info.Remaining)
+	}
+
+	// The key is kept while its bucket in the store is refilling
+	if removed := limiter.shardFor("key").sweep(clock.Now(), 0); removed != 0 {
+		t.Errorf("Expected the key to be kept, %d removed", removed)
+	}
+	clock.Advance(time.Minute)
+	if removed := limiter.shardFor("key").sweep(clock.Now(), 0); removed != 1 {
+		t.Errorf("Expected the refilled key to be removed, %d removed", removed)
+	}
+}
+
+func TestLimiterStoreZeroRefill(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStore()
+	limiter := NewLimiter(2, 0, time.Minute, WithClock(clock), WithStore(store))
+
+	if !limiter.AllowN("key", 2) || limiter.Allow("key") {
+		t.Fatal("Expected the capacity to be allowed and nothing more")
+	}
+
+	clock.Advance(24 * time.Hour)
+	if limiter.Allow("key") {
+		t.Error("Expected no tokens to be earned back with a refill rate of 0")
+	}
+	if store.Len() != 1 {
+		t.Errorf("Expected the key's state to be kept, got %d keys", store.Len())
+	}
+}
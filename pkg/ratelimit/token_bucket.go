@@ -1,32 +1,47 @@
 package ratelimit
 
 import (
+	"context"
+	"math"
+	"math/bits"
 	"sync"
 	"time"
 )
 
+// InfDuration is returned by TimeUntil when the requested tokens can never become available
+const InfDuration = time.Duration(math.MaxInt64)
+
 // TokenBucket implements a token bucket rate limiter
 // Safe for concurrent use by multiple goroutines
 type TokenBucket struct {
-	capacity  int64         // Maximum tokens
-	tokens    int64         // Current tokens
-	refillRate int64        // Tokens added per refill interval
-	interval  time.Duration // Refill interval
+	capacity   int64         // Maximum tokens
+	tokens     int64         // Current tokens
+	refillRate int64         // Tokens added per refill interval
+	interval   time.Duration // Refill interval
 	lastRefill time.Time
-	mu        sync.Mutex
+	mode       RefillMode
+	credit     int64 // Partial token progress for continuous refill, in token-nanoseconds
+	clock      Clock
+	mu         sync.Mutex
 }
 
 // NewTokenBucket creates a new token bucket rate limiter
 // capacity: maximum number of tokens
 // refillRate: number of tokens to add per interval
 // interval: how often to refill tokens
-func NewTokenBucket(capacity, refillRate int64, interval time.Duration) *TokenBucket {
+func NewTokenBucket(capacity, refillRate int64, interval time.Duration, opts ...Option) *TokenBucket {
+	return newTokenBucket(capacity, refillRate, interval, newOptions(opts))
+}
+
+func newTokenBucket(capacity, refillRate int64, interval time.Duration, o options) *TokenBucket {
 	return &TokenBucket{
 		capacity:   capacity,
 		tokens:     capacity,
 		refillRate: refillRate,
 		interval:   interval,
-		lastRefill: time.Now(),
+		lastRefill: o.clock.Now(),
+		mode:       o.refillMode,
+		clock:      o.clock,
 	}
 }
 
@@ -63,7 +78,12 @@ func (tb *TokenBucket) AllowN(n int64) bool {
 // refill adds tokens based on elapsed time since last refill
 // Must be called with lock held
 func (tb *TokenBucket) refill() {
-	now := time.Now()
+	now := tb.clock.Now()
+	if tb.mode == RefillContinuous {
+		tb.refillContinuous(now)
+		return
+	}
+
 	elapsed := now.Sub(tb.lastRefill)
 
 	if elapsed < tb.interval {
@@ -82,12 +102,116 @@ func (tb *TokenBucket) refill() {
 	tb.lastRefill = tb.lastRefill.Add(time.Duration(periods) * tb.interval)
 }
 
+// refillContinuous adds tokens in proportion to the time elapsed since the
+// last refill. The remainder that doesn't make up a whole token is kept in
+// credit, so no time is lost between calls.
+// Must be called with lock held
+func (tb *TokenBucket) refillContinuous(now time.Time) {
+	elapsed := now.Sub(tb.lastRefill)
+	if elapsed <= 0 {
+		return
+	}
+	tb.lastRefill = now
+
+	missing := tb.capacity - tb.tokens
+	if missing <= 0 || tb.refillRate <= 0 {
+		tb.credit = 0
+		return
+	}
+
+	// elapsed*refillRate can exceed 64 bits after long idle periods
+	hi, lo := bits.Mul64(uint64(elapsed), uint64(tb.refillRate))
+	lo, carry := bits.Add64(lo, uint64(tb.credit), 0)
+	hi += carry
+	if hi >= uint64(tb.interval) {
+		// More tokens than fit in 64 bits: the bucket is certainly full
+		tb.tokens = tb.capacity
+		tb.credit = 0
+		return
+	}
+
+	added, credit := bits.Div64(hi, lo, uint64(tb.interval))
+	if added >= uint64(missing) {
+		tb.tokens = tb.capacity
+		tb.credit = 0
+		return
+	}
+
+	tb.tokens += int64(added)
+	tb.credit = int64(credit)
+}
+
+// TimeUntil returns how long until n tokens are available, or 0 if they
+// already are. It returns InfDuration if n exceeds the capacity or the
+// bucket never refills.
+func (tb *TokenBucket) TimeUntil(n int64) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	return tb.delayFor(n, tb.clock.Now())
+}
+
+// delayFor returns how long after now the bucket will hold n tokens
+// Must be called with lock held, after refill
+func (tb *TokenBucket) delayFor(n int64, now time.Time) time.Duration {
+	need := n - tb.tokens
+	if need <= 0 {
+		return 0
+	}
+	if n > tb.capacity || tb.refillRate <= 0 {
+		return InfDuration
+	}
+
+	if tb.mode == RefillContinuous {
+		// Nanoseconds to earn need*interval token-nanoseconds, less the credit already earned
+		hi, lo := bits.Mul64(uint64(need), uint64(tb.interval))
+		lo, borrow := bits.Sub64(lo, uint64(tb.credit), 0)
+		hi -= borrow
+		if hi >= uint64(tb.refillRate) {
+			return InfDuration
+		}
+		ns, rem := bits.Div64(hi, lo, uint64(tb.refillRate))
+		if rem > 0 {
+			ns++
+		}
+		if ns > math.MaxInt64 {
+			return InfDuration
+		}
+		return time.Duration(ns)
+	}
+
+	periods := (need + tb.refillRate - 1) / tb.refillRate
+	return tb.lastRefill.Add(time.Duration(periods) * tb.interval).Sub(now)
+}
+
+// reconfigure applies new limits, keeping the used tokens or, with rescale,
+// their share of the capacity
+func (tb *TokenBucket) reconfigure(p Policy, rescale bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+
+	used := carry(tb.capacity-tb.tokens, tb.capacity, p.Capacity, rescale)
+	tb.capacity = p.Capacity
+	tb.refillRate = p.RefillRate
+	tb.interval = p.Interval
+	tb.tokens = p.Capacity - used
+	// Partial progress was measured against the old rate
+	tb.credit = 0
+}
+
 // Available returns the current number of available tokens
 func (tb *TokenBucket) Available() int64 {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
 	tb.refill()
+	if tb.tokens < 0 {
+		// Tokens reserved ahead of time are owed before any become available
+		return 0
+	}
 	return tb.tokens
 }
 
@@ -95,3 +219,83 @@ func (tb *TokenBucket) Available() int64 {
 func (tb *TokenBucket) Capacity() int64 {
 	return tb.capacity
 }
+
+// Reserve reserves one token; see ReserveN
+func (tb *TokenBucket) Reserve() *Reservation {
+	return tb.ReserveN(1)
+}
+
+// ReserveN takes n tokens now, even if they haven't been refilled yet, and
+// returns a reservation saying how long the caller must wait before using
+// them. Tokens owed by reservations are repaid by future refills before
+// Allow admits anything. The reservation is not OK if n exceeds capacity.
+func (tb *TokenBucket) ReserveN(n int64) *Reservation {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	now := tb.clock.Now()
+
+	delay := tb.delayFor(n, now)
+	if delay == InfDuration {
+		return &Reservation{}
+	}
+
+	tb.tokens -= n
+
+	return &Reservation{
+		ok:        true,
+		tokens:    n,
+		timeToAct: now.Add(delay),
+		clock:     tb.clock,
+		cancel:    func() { tb.refund(n) },
+	}
+}
+
+// refund gives back n tokens, such as those held by a cancelled reservation
+func (tb *TokenBucket) refund(n int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	tb.tokens += n
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+}
+
+// state returns the bucket's tokens and refill progress
+func (tb *TokenBucket) state() bucketState {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return bucketState{Tokens: tb.tokens, Credit: tb.credit, At: tb.lastRefill}
+}
+
+// setState restores the bucket saved by state. Time that passed since the
+// last refill is made up by the next refill.
+func (tb *TokenBucket) setState(s bucketState) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.tokens = min(s.Tokens, tb.capacity)
+	tb.lastRefill = s.At
+	if tb.mode == RefillContinuous {
+		tb.credit = s.Credit
+	}
+}
+
+// Wait blocks until a token is available; see WaitN
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	return tb.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n tokens are available and consumes them. It returns
+// an error if n exceeds capacity, ctx is cancelled, or the wait would last
+// past ctx's deadline; in those cases no tokens are consumed.
+func (tb *TokenBucket) WaitN(ctx context.Context, n int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return waitReservation(ctx, tb.ReserveN(n))
+}
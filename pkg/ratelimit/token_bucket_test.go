@@ -4,8 +4,15 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/manuelondina/goroutine-3000/pkg/ratelimit/ratelimittest"
 )
 
+// newTestClock returns a fake clock for deterministic refill tests
+func newTestClock() *ratelimittest.Clock {
+	return ratelimittest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
 func TestNewTokenBucket(t *testing.T) {
 	tb := NewTokenBucket(10, 5, time.Second)
 
@@ -64,7 +71,8 @@ func TestTokenBucketAllowN(t *testing.T) {
 }
 
 func TestTokenBucketRefill(t *testing.T) {
-	tb := NewTokenBucket(10, 10, 100*time.Millisecond)
+	clock := newTestClock()
+	tb := NewTokenBucket(10, 10, 100*time.Millisecond, WithClock(clock))
 
 	// Consume all tokens
 	for i := 0; i < 10; i++ {
@@ -75,8 +83,14 @@ func TestTokenBucketRefill(t *testing.T) {
 		t.Errorf("Expected 0 available tokens, got %d", tb.Available())
 	}
 
+	// Not refilled until the full interval has passed
+	clock.Advance(99 * time.Millisecond)
+	if available := tb.Available(); available != 0 {
+		t.Errorf("Expected 0 available tokens before the interval, got %d", available)
+	}
+
 	// Wait for refill
-	time.Sleep(150 * time.Millisecond)
+	clock.Advance(time.Millisecond)
 
 	// Should have refilled
 	available := tb.Available()
@@ -139,3 +153,91 @@ func BenchmarkTokenBucketAllowConcurrent(b *testing.B) {
 		}
 	})
 }
+
+func TestTokenBucketContinuousRefill(t *testing.T) {
+	clock := newTestClock()
+	// One token every 10ms
+	tb := NewTokenBucket(10, 10, 100*time.Millisecond, WithRefillMode(RefillContinuous), WithClock(clock))
+
+	if !tb.AllowN(10) {
+		t.Fatal("AllowN(10) should succeed")
+	}
+
+	// Stepwise refill would still be at 0 until the full interval passes
+	clock.Advance(35 * time.Millisecond)
+	if available := tb.Available(); available != 3 {
+		t.Errorf("Expected 3 tokens after 35ms, got %d", available)
+	}
+
+	// The leftover 5ms carries over to the next token
+	clock.Advance(5 * time.Millisecond)
+	if available := tb.Available(); available != 4 {
+		t.Errorf("Expected 4 tokens after 40ms, got %d", available)
+	}
+
+	// Long idle periods refill to capacity, never beyond
+	clock.Advance(24 * time.Hour)
+	if available := tb.Available(); available != 10 {
+		t.Errorf("Expected a full bucket, got %d", available)
+	}
+}
+
+func TestTokenBucketContinuousRefillFractional(t *testing.T) {
+	clock := newTestClock()
+	// Three tokens per second: one every 333.33ms
+	tb := NewTokenBucket(3, 3, time.Second, WithRefillMode(RefillContinuous), WithClock(clock))
+	tb.AllowN(3)
+
+	for i := 0; i < 3; i++ {
+		clock.Advance(333 * time.Millisecond)
+	}
+	if available := tb.Available(); available != 2 {
+		t.Errorf("Expected 2 tokens after 999ms, got %d", available)
+	}
+
+	clock.Advance(time.Millisecond)
+	if available := tb.Available(); available != 3 {
+		t.Errorf("Expected no time lost to rounding, got %d tokens after 1s", available)
+	}
+}
+
+func TestTokenBucketTimeUntil(t *testing.T) {
+	t.Run("stepwise", func(t *testing.T) {
+		clock := newTestClock()
+		tb := NewTokenBucket(10, 10, time.Minute, WithClock(clock))
+		tb.AllowN(10)
+
+		clock.Advance(20 * time.Second)
+		if wait := tb.TimeUntil(1); wait != 40*time.Second {
+			t.Errorf("Expected to wait for the rest of the interval (40s), got %v", wait)
+		}
+	})
+
+	t.Run("continuous", func(t *testing.T) {
+		clock := newTestClock()
+		tb := NewTokenBucket(10, 10, time.Minute, WithRefillMode(RefillContinuous), WithClock(clock))
+		tb.AllowN(10)
+
+		clock.Advance(2 * time.Second)
+		if wait := tb.TimeUntil(1); wait != 4*time.Second {
+			t.Errorf("Expected to wait for the rest of one token (4s), got %v", wait)
+		}
+		if wait := tb.TimeUntil(3); wait != 16*time.Second {
+			t.Errorf("Expected to wait 16s for three tokens, got %v", wait)
+		}
+	})
+
+	t.Run("available", func(t *testing.T) {
+		tb := NewTokenBucket(10, 10, time.Minute)
+		if wait := tb.TimeUntil(5); wait != 0 {
+			t.Errorf("Expected no wait, got %v", wait)
+		}
+	})
+
+	t.Run("over capacity", func(t *testing.T) {
+		tb := NewTokenBucket(10, 10, time.Minute)
+		if wait := tb.TimeUntil(11); wait != InfDuration {
+			t.Errorf("Expected InfDuration, got %v", wait)
+		}
+	})
+}